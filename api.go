@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/hod"
+	"github.com/cp16net/hod-test-app/mongo"
+	"github.com/cp16net/hod-test-app/mysql"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/outbox"
+	"github.com/cp16net/hod-test-app/postgres"
+	"github.com/cp16net/hod-test-app/rabbitmq"
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/cp16net/hod-test-app/sqlite"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// APIError is the body of every failed api call
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// Write a value out as indented json
+func renderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		common.Logger.Error(err)
+	}
+}
+
+// Write an error out as json, backends that are not ready answer 503
+func renderAPIError(w http.ResponseWriter, status int, err error) {
+	if common.IsUnavailable(err) {
+		status = http.StatusServiceUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		common.Logger.Error(err)
+	}
+	renderJSON(w, status, APIError{Error: err.Error()})
+}
+
+// Read a json request body into v
+func decodeJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return errors.New("request body is required")
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid json body: %s", err)
+	}
+	return nil
+}
+
+// knownSQLBackends by the name used in api paths and the configuration
+var knownSQLBackends = map[string]store.UserStore{
+	"mysql":    mysql.Store,
+	"postgres": postgres.Store,
+	"sqlite":   sqlite.Store,
+}
+
+var (
+	// sqlBackends that are enabled, by the name used in api paths
+	sqlBackends map[string]store.UserStore
+	// sqlBackendNames of the enabled backends in the order they are
+	// reported, the first one takes the generated users
+	sqlBackendNames []string
+)
+
+// enableSQLBackends picks the sql backends the app uses
+func enableSQLBackends(names []string) error {
+	if len(names) == 0 {
+		return errors.New("at least one sql backend has to be enabled")
+	}
+	enabled := make(map[string]store.UserStore, len(names))
+	for _, name := range names {
+		backend, ok := knownSQLBackends[name]
+		if !ok {
+			return fmt.Errorf("unknown sql backend %q", name)
+		}
+		if _, ok := enabled[name]; ok {
+			return fmt.Errorf("sql backend %q given twice", name)
+		}
+		enabled[name] = backend
+	}
+	sqlBackends, sqlBackendNames = enabled, names
+	return nil
+}
+
+// lookupSQLBackend answers 404 for unknown backends
+func lookupSQLBackend(w http.ResponseWriter, ps httprouter.Params) (store.UserStore, bool) {
+	backend, ok := sqlBackends[ps.ByName("backend")]
+	if !ok {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("unknown sql backend %q", ps.ByName("backend")))
+	}
+	return backend, ok
+}
+
+// listOptions reads ?page=, per_page=, sort=, order=asc|desc,
+// deleted=true|all, username=, email=, created_after= and created_before=
+func listOptions(r *http.Request) (models.ListOptions, error) {
+	q := r.URL.Query()
+	opts := models.ListOptions{
+		Sort:     q.Get("sort"),
+		Username: strings.TrimSpace(q.Get("username")),
+		Email:    strings.TrimSpace(q.Get("email")),
+	}
+	switch q.Get("deleted") {
+	case "", "false":
+	case "true":
+		opts.Deleted = true
+	case "all":
+		opts.IncludeDeleted = true
+	default:
+		return opts, errors.New("deleted must be true, false or all")
+	}
+	for name, dst := range map[string]**time.Time{"created_after": &opts.CreatedAfter, "created_before": &opts.CreatedBefore} {
+		if v := strings.TrimSpace(q.Get(name)); v != "" {
+			t, err := models.ParseTimeFilter(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %s", name, err)
+			}
+			*dst = t
+		}
+	}
+	for name, dst := range map[string]*int{"page": &opts.Page, "per_page": &opts.PerPage} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("%s must be a positive integer", name)
+			}
+			*dst = n
+		}
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+	opts = opts.Normalize()
+	return opts, opts.Validate()
+}
+
+// userID reads the :id path parameter
+func userID(ps httprouter.Params) (uint, error) {
+	id, err := strconv.ParseUint(ps.ByName("id"), 10, 0)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%q is not a user id", ps.ByName("id"))
+	}
+	return uint(id), nil
+}
+
+// renderUserError answers 404 for users that do not exist
+func renderUserError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == models.ErrUserNotFound {
+		status = http.StatusNotFound
+	}
+	renderAPIError(w, status, err)
+}
+
+// APIUsers is a page of the user listing of one sql backend
+type APIUsers struct {
+	*models.UserPage
+	Error string `json:"error,omitempty"`
+}
+
+func apiUsersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	opts, err := listOptions(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	result := make(map[string]APIUsers, len(sqlBackendNames))
+	status := http.StatusOK
+	for _, name := range sqlBackendNames {
+		page, err := sqlBackends[name].ListUsers(opts)
+		if err != nil {
+			common.Logger.Error(err)
+			result[name] = APIUsers{Error: err.Error()}
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		result[name] = APIUsers{UserPage: &page}
+	}
+	renderJSON(w, status, result)
+}
+
+// apiGenerateUsersHandler writes one user to the primary backend, the
+// others get it through the outbox
+func apiGenerateUsersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	result, err := generateUser()
+	if err != nil {
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	renderJSON(w, http.StatusCreated, result)
+}
+
+// APIOutbox is the state of the outbox of the primary sql backend
+type APIOutbox struct {
+	Backend string         `json:"backend"`
+	Pending int            `json:"pending"`
+	Entries []outbox.Entry `json:"entries"`
+}
+
+func apiOutboxHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	store, err := sqlBackends[primarySQLBackend()].Outbox()
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := APIOutbox{Backend: primarySQLBackend()}
+	if result.Pending, err = store.PendingCount(); err == nil {
+		result.Entries, err = store.Pending(100)
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, result)
+}
+
+func apiBackendUsersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, ok := lookupSQLBackend(w, ps)
+	if !ok {
+		return
+	}
+	opts, err := listOptions(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := backend.ListUsers(opts)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, page)
+}
+
+// userRequest resolves the backend and user id of a request, answering
+// 404 or 400 itself when they are not valid
+func userRequest(w http.ResponseWriter, ps httprouter.Params) (store.UserStore, uint, bool) {
+	backend, ok := lookupSQLBackend(w, ps)
+	if !ok {
+		return backend, 0, false
+	}
+	id, err := userID(ps)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return backend, 0, false
+	}
+	return backend, id, true
+}
+
+func apiUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userRequest(w, ps)
+	if !ok {
+		return
+	}
+	user, err := backend.User(id)
+	if err != nil {
+		renderUserError(w, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, user)
+}
+
+func apiUpdateUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userRequest(w, ps)
+	if !ok {
+		return
+	}
+	update := models.UserUpdate{}
+	if err := decodeJSON(r, &update); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, err := backend.UpdateUser(id, update)
+	if err != nil {
+		renderUserError(w, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, user)
+}
+
+// apiDeleteUserHandler soft deletes the user, or removes it for good with
+// ?purge=true
+func apiDeleteUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userRequest(w, ps)
+	if !ok {
+		return
+	}
+	remove := backend.DeleteUser
+	if r.URL.Query().Get("purge") == "true" {
+		remove = backend.PurgeUser
+	}
+	if err := remove(id); err != nil {
+		renderUserError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRestoreUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userRequest(w, ps)
+	if !ok {
+		return
+	}
+	if err := backend.RestoreUser(id); err != nil {
+		renderUserError(w, err)
+		return
+	}
+	user, err := backend.User(id)
+	if err != nil {
+		renderUserError(w, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, user)
+}
+
+// APIRedisKey is a single redis key and its value
+type APIRedisKey struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// TTL in seconds, 0 for a key that does not expire
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// APICounter is the value of the redis counter
+type APICounter struct {
+	Counter int64 `json:"counter"`
+}
+
+// apiRedisKeysHandler scans a page of keys, ?cursor= takes the next one
+// from the last page until it is 0 again
+func apiRedisKeysHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	scan, err := redisScan(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := redis.ScanKeys(scan.Cursor, scan.Match, scan.Count)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, page)
+}
+
+// apiRedisGetKeyHandler reads the key with a page of its value
+func apiRedisGetKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	scan, err := redisScan(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	key := ps.ByName("key")
+	v, err := redis.ReadKey(key, scan.Cursor, scan.Count)
+	if err == redis.ErrKeyNotFound {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, v)
+}
+
+func apiRedisDeleteKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	err := redis.Delete(key)
+	if err == redis.ErrKeyNotFound {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiRedisSetKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APIRedisKey{}
+	if err := decodeJSON(r, &body); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	body.Key = ps.ByName("key")
+	ttl, err := ttlSeconds(body.TTL, false)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := redis.Set(body.Key, body.Value, ttl); err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, body)
+}
+
+func apiRedisCounterHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := redis.GetCount()
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, APICounter{Counter: n})
+}
+
+func apiRedisIncrementHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := redis.Increment()
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, APICounter{Counter: n})
+}
+
+// apiHodHandler answers the havenondemand lookup of a coordinate as is
+func apiHodHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	lat, lng, err := hod.ParseCoordinate(ps.ByName("lat"), ps.ByName("lng"))
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := hod.Lookup(lat, lng)
+	if err != nil {
+		renderAPIError(w, hod.ErrorStatus(err), err)
+		return
+	}
+	renderJSON(w, http.StatusOK, json.RawMessage(body))
+}
+
+func apiPurgeUserHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userRequest(w, ps)
+	if !ok {
+		return
+	}
+	if err := backend.PurgeUser(id); err != nil {
+		renderUserError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIFib is the input and result of a fibonacci rpc call
+type APIFib struct {
+	Input  int `json:"input"`
+	Output int `json:"output"`
+}
+
+func apiFibHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := parseCount("n", ps.ByName("n"), 0, rabbitmq.MaxFib)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	out, err := rabbitmq.FibonacciRPC(n)
+	switch err {
+	case nil:
+	case rabbitmq.ErrBusy:
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	case rabbitmq.ErrReplyTimeout:
+		renderAPIError(w, http.StatusGatewayTimeout, err)
+		return
+	default:
+		renderAPIError(w, http.StatusBadGateway, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, APIFib{Input: n, Output: out})
+}
+
+// APILogRequest asks for a number of random log messages to be written
+type APILogRequest struct {
+	Count int `json:"count"`
+}
+
+func apiGenerateLogsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APILogRequest{}
+	if err := decodeJSON(r, &body); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Count < 1 || body.Count > rabbitmq.MaxLogs {
+		renderAPIError(w, http.StatusBadRequest, fmt.Errorf("count must be between 1 and %d", rabbitmq.MaxLogs))
+		return
+	}
+	if err := rabbitmq.Ready(); err != nil {
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	go func() {
+		if err := rabbitmq.WriteLogs(body.Count); err != nil {
+			common.Logger.Error(err)
+		}
+	}()
+	renderJSON(w, http.StatusAccepted, body)
+}
+
+func apiLogsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	logs, err := mongo.GetLogs()
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, logs)
+}
+
+// apiRoutes registers the json api mirroring every html page
+func apiRoutes(router instrumentedRouter) {
+	router.GET("/api/v1/users", cached(usersCache, usersKey, apiUsersHandler))
+	router.POST("/api/v1/users", limited(actionSQLGenerate, requireAPILogin(audited(actionSQLGenerate, invalidates(usersCache, apiGenerateUsersHandler)))))
+	router.GET("/api/v1/users/:backend", cached(usersCache, usersKey, apiBackendUsersHandler))
+	router.GET("/api/v1/users/:backend/:id", apiUserHandler)
+	router.Handle("PUT", "/api/v1/users/:backend/:id", limited(actionUserUpdate, requireAPILogin(audited(actionUserUpdate, invalidates(usersCache, apiUpdateUserHandler)))))
+	router.Handle("DELETE", "/api/v1/users/:backend/:id", limited(actionUserDelete, requireAPILogin(audited(actionUserDelete, invalidates(usersCache, apiDeleteUserHandler)))))
+	router.POST("/api/v1/users/:backend/:id/restore", limited(actionUserRestore, requireAPILogin(audited(actionUserRestore, invalidates(usersCache, apiRestoreUserHandler)))))
+	router.POST("/api/v1/users/:backend/:id/purge", limited(actionUserPurge, requireAPILogin(audited(actionUserPurge, invalidates(usersCache, apiPurgeUserHandler)))))
+
+	router.GET("/api/v1/export/:backend", requireAPILogin(apiExportHandler))
+	router.POST("/api/v1/import/:backend", limited(actionSQLImport, requireAPILogin(audited(actionSQLImport, invalidates(usersCache, apiImportHandler)))))
+	router.GET("/api/v1/outbox", apiOutboxHandler)
+	router.POST("/api/v1/load", limited(actionSQLLoad, requireAPILogin(audited(actionSQLLoad, apiLoadHandler))))
+	router.GET("/api/v1/load/:id", apiLoadRunHandler)
+	router.GET("/api/v1/consistency", requireAPILogin(apiConsistencyHandler))
+	router.POST("/api/v1/consistency/reconcile", limited(actionSQLReconcile, requireAPILogin(audited(actionSQLReconcile, invalidates(usersCache, apiReconcileHandler)))))
+
+	router.GET("/api/v1/redis/keys", apiRedisKeysHandler)
+	router.GET("/api/v1/redis/keys/:key", apiRedisGetKeyHandler)
+	router.Handle("PUT", "/api/v1/redis/keys/:key", limited(actionRedisSet, requireAPILogin(audited(actionRedisSet, apiRedisSetKeyHandler))))
+	router.Handle("DELETE", "/api/v1/redis/keys/:key", limited(actionRedisDelete, requireAPILogin(audited(actionRedisDelete, apiRedisDeleteKeyHandler))))
+	router.Handle("PUT", "/api/v1/redis/keys/:key/ttl", limited(actionRedisExpire, requireAPILogin(audited(actionRedisExpire, apiRedisExpireHandler))))
+	router.Handle("DELETE", "/api/v1/redis/keys/:key/ttl", limited(actionRedisPersist, requireAPILogin(audited(actionRedisPersist, apiRedisPersistHandler))))
+	router.POST("/api/v1/redis/expiry", limited(actionRedisExpiryDemo, requireAPILogin(audited(actionRedisExpiryDemo, apiRedisExpiryStartHandler))))
+	router.GET("/api/v1/redis/expiry/:id", apiRedisExpiryHandler)
+	router.POST("/api/v1/redis/publish", limited(actionRedisPublish, requireAPILogin(audited(actionRedisPublish, apiPublishHandler))))
+	router.GET("/api/v1/redis/subscribe", requireAPILogin(streamHandler))
+	router.GET("/api/v1/redis/counter", apiRedisCounterHandler)
+	router.POST("/api/v1/redis/counter", limited(actionRedisIncrement, requireAPILogin(audited(actionRedisIncrement, apiRedisIncrementHandler))))
+
+	router.GET("/api/v1/fib/:n", limited(actionRabbitmqFib, requireAPILogin(audited(actionRabbitmqFib, apiFibHandler))))
+	router.GET("/api/v1/hod/:lat/:lng", cached(hodCache, hodKey, apiHodHandler))
+
+	router.POST("/api/v1/login", limited(actionUserLogin, audited(actionUserLogin, apiLoginHandler)))
+	router.POST("/api/v1/logout", apiLogoutHandler)
+	router.GET("/api/v1/session", apiSessionHandler)
+
+	router.GET("/api/v1/env", apiEnvHandler)
+
+	router.GET("/api/v1/audit", requireAPILogin(apiAuditHandler))
+
+	router.GET("/api/v1/logs", apiLogsHandler)
+	router.POST("/api/v1/logs", limited(actionLogsGenerate, requireAPILogin(audited(actionLogsGenerate, apiGenerateLogsHandler))))
+}
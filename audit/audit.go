@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Outcomes of an audited action
+const (
+	OK    = "ok"
+	Error = "error"
+)
+
+// DefaultPerPage and MaxPerPage size a page of the audit log
+const (
+	DefaultPerPage = 50
+	MaxPerPage     = 200
+)
+
+// Widths of the audit log columns that hold what a client sent, longer
+// values are cut to fit
+const (
+	MaxRequestID = 64
+	MaxClientIP  = 64
+	MaxPath      = 1024
+)
+
+// Entry is one action someone took, as recorded after it finished
+type Entry struct {
+	ID        uint64    `json:"id" gorm:"primary_key"`
+	CreatedAt time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Instance  string    `json:"instance"`
+	ClientIP  string    `json:"client_ip"`
+	// Backend and UserID say where the logged in user lives, both are
+	// empty for anonymous actions
+	Backend  string `json:"backend,omitempty"`
+	UserID   uint   `json:"user_id,omitempty"`
+	Username string `json:"username"`
+	Action   string `json:"action"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+	Outcome  string `json:"outcome"`
+}
+
+// TableName of the audit log, created by the migrations
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+// Filter selects a page of the audit log, newest first
+type Filter struct {
+	Username string     `json:"username,omitempty"`
+	Action   string     `json:"action,omitempty"`
+	Outcome  string     `json:"outcome,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Page     int        `json:"page"`
+	PerPage  int        `json:"per_page"`
+}
+
+// Normalize fills in the defaults and clamps the page size
+func (f Filter) Normalize() Filter {
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultPerPage
+	}
+	if f.PerPage > MaxPerPage {
+		f.PerPage = MaxPerPage
+	}
+	return f
+}
+
+// Validate checks that the filter can match anything
+func (f Filter) Validate() error {
+	switch f.Outcome {
+	case "", OK, Error:
+	default:
+		return fmt.Errorf("outcome must be %s or %s", OK, Error)
+	}
+	if f.Since != nil && f.Until != nil && !f.Since.Before(*f.Until) {
+		return errors.New("since must be before until")
+	}
+	return nil
+}
+
+// Page of the audit log
+type Page struct {
+	Filter
+	Total   int     `json:"total"`
+	Pages   int     `json:"pages"`
+	Entries []Entry `json:"entries"`
+}
+
+// HasPrev reports whether there is a page before this one
+func (p Page) HasPrev() bool {
+	return p.Page > 1
+}
+
+// HasNext reports whether there is a page after this one
+func (p Page) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+// Store reads and writes the audit log of one database
+type Store struct {
+	db *gorm.DB
+}
+
+// NewStore for the audit log table of db
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+// Record adds an entry to the audit log
+func (s *Store) Record(e *Entry) error {
+	e.RequestID = truncate(e.RequestID, MaxRequestID)
+	e.ClientIP = truncate(e.ClientIP, MaxClientIP)
+	e.Path = truncate(e.Path, MaxPath)
+	return s.db.Create(e).Error
+}
+
+// truncate s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// List returns the page of entries matching the filter
+func (s *Store) List(f Filter) (page Page, err error) {
+	f = f.Normalize()
+	if err := f.Validate(); err != nil {
+		return page, err
+	}
+	q := s.db.Model(&Entry{})
+	if f.Username != "" {
+		q = q.Where("username = ?", f.Username)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		q = q.Where("outcome = ?", f.Outcome)
+	}
+	if f.Since != nil {
+		q = q.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		q = q.Where("created_at < ?", *f.Until)
+	}
+	page = Page{Filter: f, Entries: []Entry{}}
+	if err := q.Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+	page.Pages = (page.Total + f.PerPage - 1) / f.PerPage
+	err = q.Order("id desc").Offset((f.Page - 1) * f.PerPage).Limit(f.PerPage).Find(&page.Entries).Error
+	return page, err
+}
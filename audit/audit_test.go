@@ -0,0 +1,44 @@
+package audit_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/cp16net/hod-test-app/audit"
+	"github.com/cp16net/hod-test-app/sqlite"
+)
+
+func TestRecordFitsColumns(t *testing.T) {
+	sqlite.Path = ":memory:"
+	store, err := sqlite.Store.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &audit.Entry{
+		RequestID: strings.Repeat("r", 100),
+		ClientIP:  strings.Repeat("1.2.3.4,", 20),
+		// a character must not be split at the cut
+		Path:    "/" + strings.Repeat("é", audit.MaxPath),
+		Action:  "test.long",
+		Method:  "GET",
+		Outcome: audit.OK,
+	}
+	if err := store.Record(entry); err != nil {
+		t.Fatal(err)
+	}
+	page, err := store.List(audit.Filter{Action: "test.long"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 {
+		t.Fatalf("got %d entries", len(page.Entries))
+	}
+	got := page.Entries[0]
+	if len(got.RequestID) != audit.MaxRequestID || len(got.ClientIP) != audit.MaxClientIP {
+		t.Errorf("request id of %d and client ip of %d bytes", len(got.RequestID), len(got.ClientIP))
+	}
+	if len(got.Path) > audit.MaxPath || len(got.Path) < audit.MaxPath-1 || !utf8.ValidString(got.Path) {
+		t.Errorf("path of %d bytes, valid utf-8 %v", len(got.Path), utf8.ValidString(got.Path))
+	}
+}
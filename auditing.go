@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cp16net/hod-test-app/audit"
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Actions recorded in the audit log
+const (
+	actionSQLGenerate     = "sql.generate"
+	actionSQLImport       = "sql.import"
+	actionSQLLoad         = "sql.load"
+	actionSQLReconcile    = "sql.reconcile"
+	actionUserUpdate      = "user.update"
+	actionUserDelete      = "user.delete"
+	actionUserRestore     = "user.restore"
+	actionUserPurge       = "user.purge"
+	actionUserSignup      = "user.signup"
+	actionUserLogin       = "user.login"
+	actionRedisIncrement  = "redis.increment"
+	actionRedisSet        = "redis.set"
+	actionRedisDelete     = "redis.delete"
+	actionRedisExpire     = "redis.expire"
+	actionRedisPersist    = "redis.persist"
+	actionRedisExpiryDemo = "redis.expiry_demo"
+	actionRedisPublish    = "redis.publish"
+	actionLogsGenerate    = "logs.generate"
+	actionRabbitmqFib     = "rabbitmq.fib"
+)
+
+// auditActions are offered by the filter of the audit page
+var auditActions = []string{
+	actionSQLGenerate, actionSQLImport, actionSQLLoad, actionSQLReconcile,
+	actionUserUpdate, actionUserDelete, actionUserRestore, actionUserPurge,
+	actionUserSignup, actionUserLogin, actionRedisIncrement, actionRedisSet,
+	actionRedisDelete, actionRedisExpire, actionRedisPersist, actionRedisExpiryDemo,
+	actionRedisPublish, actionLogsGenerate, actionRabbitmqFib,
+}
+
+var auditFailures = common.NewCounter("audit_failures_total",
+	"Audit entries that could not be stored, by action.", "action")
+
+// requestIDHeader carries the id of a request, gorouter sends its own as
+// X-Vcap-Request-Id
+const requestIDHeader = "X-Request-Id"
+
+// setRequestID keeps the id the request came with, or makes one up when it
+// has none or one that does not fit the audit log. It is set on the request
+// and echoed on the response so both ends can refer to it.
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = r.Header.Get("X-Vcap-Request-Id")
+	}
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			common.Logger.Panicf("Unable to make a request id: %s", err)
+		}
+		id = hex.EncodeToString(b)
+	}
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+}
+
+// validRequestID is a non empty id of printable ascii that fits the audit
+// log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > audit.MaxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// trustedProxies is how many proxies in front of the app add the address
+// they were reached from to X-Forwarded-For, gorouter is one
+var trustedProxies = 0
+
+// platformProxies is how many proxies to trust by default, gorouter when
+// running on the platform and none when run locally
+func platformProxies() int {
+	if os.Getenv("CF_INSTANCE_INDEX") != "" || os.Getenv("VCAP_APPLICATION") != "" {
+		return 1
+	}
+	return 0
+}
+
+// clientIP is the address the outermost trusted proxy was reached from,
+// counted from the right of X-Forwarded-For since a client can put anything
+// on the left of it, or else the address of the connection when there are
+// fewer hops than trusted proxies
+func clientIP(r *http.Request) string {
+	var hops []string
+	for _, fwd := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(fwd, ",")...)
+	}
+	if trustedProxies > 0 && len(hops) >= trustedProxies {
+		if hop := strings.TrimSpace(hops[len(hops)-trustedProxies]); hop != "" {
+			return hop
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// instanceIndex of this app instance on the platform, empty when run
+// locally
+func instanceIndex() string {
+	if index := os.Getenv("CF_INSTANCE_INDEX"); index != "" {
+		return index
+	}
+	return os.Getenv("INSTANCE_INDEX")
+}
+
+// auditStore is the audit log in the primary sql backend
+func auditStore() (*audit.Store, error) {
+	return sqlBackends[primarySQLBackend()].Audit()
+}
+
+// audited records the action in the audit log once the handler is done,
+// the status it answered with decides the outcome
+func audited(action string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r, ps)
+
+		entry := &audit.Entry{
+			RequestID: r.Header.Get(requestIDHeader),
+			Instance:  instanceIndex(),
+			ClientIP:  clientIP(r),
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Status:    rec.status,
+			Outcome:   audit.OK,
+		}
+		if s, ok := currentSession(r); ok {
+			entry.Backend, entry.UserID, entry.Username = s.Backend, s.UserID, s.Username
+		}
+		if rec.status >= http.StatusBadRequest {
+			entry.Outcome = audit.Error
+		}
+		// the answer is sent already, a slow audit log should not hold up
+		// the next request on the connection
+		go recordAudit(entry)
+	}
+}
+
+func recordAudit(entry *audit.Entry) {
+	var err error
+	defer common.ObserveCall("audit", "Record", time.Now(), &err)
+	store, err := auditStore()
+	if err == nil {
+		err = store.Record(entry)
+	}
+	if err != nil {
+		auditFailures.Inc(entry.Action)
+		common.Logger.Errorf("unable to audit %s by %q (request %s, status %d): %s",
+			entry.Action, entry.Username, entry.RequestID, entry.Status, err)
+	}
+}
+
+// auditFilter reads the filter of the audit log from the query
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Username: strings.TrimSpace(q.Get("username")),
+		Action:   q.Get("action"),
+		Outcome:  q.Get("outcome"),
+	}
+	for name, dst := range map[string]**time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := strings.TrimSpace(q.Get(name)); v != "" {
+			t, err := models.ParseTimeFilter(v)
+			if err != nil {
+				return f, fmt.Errorf("%s: %s", name, err)
+			}
+			*dst = t
+		}
+	}
+	for name, dst := range map[string]*int{"page": &f.Page, "per_page": &f.PerPage} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return f, fmt.Errorf("%s must be a positive integer", name)
+			}
+			*dst = n
+		}
+	}
+	f = f.Normalize()
+	return f, f.Validate()
+}
+
+// auditQuery is the query string of the filter
+func auditQuery(f audit.Filter) url.Values {
+	q := url.Values{}
+	q.Set("page", strconv.Itoa(f.Page))
+	q.Set("per_page", strconv.Itoa(f.PerPage))
+	for name, v := range map[string]string{
+		"username": f.Username,
+		"action":   f.Action,
+		"outcome":  f.Outcome,
+		"since":    models.FormatTimeFilter(f.Since),
+		"until":    models.FormatTimeFilter(f.Until),
+	} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	return q
+}
+
+// auditPageURL links to the page of the audit log delta pages away
+func auditPageURL(f audit.Filter, delta int) string {
+	f.Page += delta
+	return "/audit?" + auditQuery(f).Encode()
+}
+
+// listAudit reads a page of the audit log
+func listAudit(f audit.Filter) (audit.Page, error) {
+	store, err := auditStore()
+	if err != nil {
+		return audit.Page{Filter: f}, err
+	}
+	return store.List(f)
+}
+
+// AuditData for the audit page
+type AuditData struct {
+	Backend string
+	Actions []string
+	Page    audit.Page
+	Error   string
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := AuditData{Backend: primarySQLBackend(), Actions: auditActions}
+	f, err := auditFilter(r)
+	if err == nil {
+		data.Page, err = listAudit(f)
+	} else {
+		data.Page.Filter = f
+	}
+	if common.IsUnavailable(err) {
+		renderUnavailable(w, "SQL", err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+	}
+	renderTemplate(w, "templates/audit.html", data)
+}
+
+// apiAuditHandler lists the audit log newest first, filtered like the page
+func apiAuditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	f, err := auditFilter(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	page, err := listAudit(f)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, page)
+}
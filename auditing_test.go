@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cp16net/hod-test-app/audit"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(n int) { trustedProxies = n }(trustedProxies)
+	tests := []struct {
+		proxies int
+		fwd     []string
+		want    string
+	}{
+		{1, nil, "10.0.0.9"},
+		{1, []string{"203.0.113.7"}, "203.0.113.7"},
+		// whatever the client sent comes before the hop gorouter added
+		{1, []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{1, []string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{2, []string{"1.2.3.4, 203.0.113.7, 10.1.1.1"}, "203.0.113.7"},
+		// fewer hops than proxies, the header did not come through them
+		{2, []string{"203.0.113.7"}, "10.0.0.9"},
+		{0, []string{"1.2.3.4"}, "10.0.0.9"},
+		{1, []string{"1.2.3.4, "}, "10.0.0.9"},
+	}
+	for _, tt := range tests {
+		trustedProxies = tt.proxies
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.9:51234"
+		for _, fwd := range tt.fwd {
+			r.Header.Add("X-Forwarded-For", fwd)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%d proxies, X-Forwarded-For %q: got %s, want %s", tt.proxies, tt.fwd, got, tt.want)
+		}
+	}
+}
+
+func TestSetRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Vcap-Request-Id", "c0ffee-1")
+	w := httptest.NewRecorder()
+	setRequestID(w, r)
+	if got := w.Header().Get(requestIDHeader); got != "c0ffee-1" {
+		t.Errorf("the gorouter id was not kept: got %q", got)
+	}
+
+	for _, id := range []string{strings.Repeat("a", audit.MaxRequestID+1), "two words", "tab\there", "café"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(requestIDHeader, id)
+		setRequestID(httptest.NewRecorder(), r)
+		got := r.Header.Get(requestIDHeader)
+		if got == id || !validRequestID(got) {
+			t.Errorf("%q: got %q, want a new id", id, got)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	// hodCache keeps the havenondemand lookups by rounded coordinate
+	hodCache *redis.Cache
+	// usersCache keeps the user listings of the sql backends, it is
+	// invalidated whenever a user is written
+	usersCache *redis.Cache
+)
+
+// setupCaches creates the response caches from the configuration
+func setupCaches(c Config) {
+	hodCache = redis.NewCache("hod", c.HODCacheTTL)
+	usersCache = redis.NewCache("users", c.UsersCacheTTL)
+}
+
+// cachedResponse is what the response cache keeps of a response
+type cachedResponse struct {
+	Header http.Header `json:"header"`
+	Stored time.Time   `json:"stored"`
+	Body   []byte      `json:"body"`
+}
+
+// uncachedHeaders belong to one response and are not replayed
+var uncachedHeaders = []string{"Age", "Date", "Set-Cookie", "X-Cache", requestIDHeader}
+
+// cacheRecorder passes a response through while keeping a copy of it
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// cacheKey names the response of a request in a cache, ok is false for
+// requests that are not cached
+type cacheKey func(r *http.Request, ps httprouter.Params) (key string, ok bool)
+
+// cached serves the responses of h from the cache, setting X-Cache to HIT
+// or MISS. Only successful responses are kept, and not those h marked
+// Cache-Control: no-store, like a page that is missing a backend. When
+// redis is unavailable the request goes to h with X-Cache set to BYPASS.
+func cached(cache *redis.Cache, key cacheKey, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		k, ok := key(r, ps)
+		if !cache.Enabled() || !ok {
+			h(w, r, ps)
+			return
+		}
+		item, err := cache.Get(k)
+		if err != nil {
+			if !common.IsUnavailable(err) {
+				common.Logger.Error(err)
+			}
+			w.Header().Set("X-Cache", "BYPASS")
+			h(w, r, ps)
+			return
+		}
+		if item.Hit {
+			resp := cachedResponse{}
+			err := json.Unmarshal(item.Value, &resp)
+			if err == nil && resp.Header == nil {
+				err = errors.New("no headers stored")
+			}
+			if err == nil {
+				for name, values := range resp.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Age", strconv.Itoa(int(time.Since(resp.Stored)/time.Second)))
+				w.Header().Set("X-Cache", "HIT")
+				w.Write(resp.Body)
+				return
+			}
+			common.Logger.Errorf("dropping unreadable %s cache entry %s: %s", cache.Name, k, err)
+		}
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w}
+		h(rec, r, ps)
+		if rec.status != http.StatusOK || w.Header().Get("Cache-Control") == "no-store" {
+			return
+		}
+		header := http.Header{}
+		for name, values := range w.Header() {
+			header[name] = values
+		}
+		for _, name := range uncachedHeaders {
+			header.Del(name)
+		}
+		value, err := json.Marshal(cachedResponse{
+			Header: header,
+			Stored: time.Now().UTC(),
+			Body:   rec.body.Bytes(),
+		})
+		if err == nil {
+			err = item.Set(value)
+		}
+		if err != nil {
+			common.Logger.Error(err)
+		}
+	}
+}
+
+// invalidates drops everything in the cache once h wrote successfully
+func invalidates(cache *redis.Cache, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r, ps)
+		if rec.status < http.StatusBadRequest {
+			invalidate(cache)
+		}
+	}
+}
+
+// invalidate drops everything in the cache, a cache that cannot be reached
+// is left to expire
+func invalidate(cache *redis.Cache) {
+	if err := cache.Invalidate(); err != nil && !common.IsUnavailable(err) {
+		common.Logger.Errorf("could not invalidate the %s cache: %s", cache.Name, err)
+	}
+}
+
+// hodKey rounds the coordinate to HODCachePrecision decimals, so lookups
+// a few meters apart share an entry
+func hodKey(r *http.Request, ps httprouter.Params) (string, bool) {
+	lat, err := strconv.ParseFloat(ps.ByName("lat"), 64)
+	if err != nil {
+		return "", false
+	}
+	lng, err := strconv.ParseFloat(ps.ByName("lng"), 64)
+	if err != nil {
+		return "", false
+	}
+	p := AppConfig.HODCachePrecision
+	return fmt.Sprintf("%.*f,%.*f", p, lat, p, lng), true
+}
+
+// usersKey is the path with the list options in a canonical order, invalid
+// options are not cached
+func usersKey(r *http.Request, ps httprouter.Params) (string, bool) {
+	opts, err := listOptions(r)
+	if err != nil {
+		return "", false
+	}
+	return r.URL.Path + "?" + listQuery(opts).Encode(), true
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultRetryAfter is how long a failed initialization is remembered before
+// it is attempted again
+var DefaultRetryAfter = 10 * time.Second
+
+// UnavailableError is returned for calls to a backend that could not be
+// initialized
+type UnavailableError struct {
+	Backend string
+	Err     error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s is unavailable: %s", e.Backend, e.Err)
+}
+
+// IsUnavailable reports whether err came from a backend that is not ready
+func IsUnavailable(err error) bool {
+	_, ok := err.(*UnavailableError)
+	return ok
+}
+
+// Lazy initializes a backend on first use. A successful initialization is
+// kept for the life of the process, a failed one is retried on a later call
+// once RetryAfter has passed.
+type Lazy struct {
+	Name       string
+	RetryAfter time.Duration
+
+	init      func() error
+	mu        sync.Mutex
+	done      bool
+	err       error
+	attempted time.Time
+}
+
+// NewLazy creates a lazy initializer for the named backend
+func NewLazy(name string, init func() error) *Lazy {
+	return &Lazy{Name: name, RetryAfter: DefaultRetryAfter, init: init}
+}
+
+// Ready initializes the backend if needed and returns why it is unavailable
+func (l *Lazy) Ready() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return nil
+	}
+	if l.err != nil && time.Since(l.attempted) < l.RetryAfter {
+		return l.err
+	}
+	l.attempted = time.Now()
+	if err := l.init(); err != nil {
+		Logger.Warnf("%s is unavailable: %s", l.Name, err)
+		l.err = &UnavailableError{Backend: l.Name, Err: err}
+		return l.err
+	}
+	Logger.Infof("%s is ready", l.Name)
+	l.done, l.err = true, nil
+	return nil
+}
+
+// Reset forgets the initialization so the next call to Ready runs it again
+func (l *Lazy) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done, l.err = false, nil
+}
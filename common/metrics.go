@@ -0,0 +1,257 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything that can write itself in the prometheus text format
+type metric interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].metricName() < metrics[j].metricName() })
+}
+
+// WriteMetrics writes every registered metric in the prometheus text
+// exposition format
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	all := append([]metric(nil), metrics...)
+	metricsMu.Unlock()
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+// MetricsHandler serves the registered metrics to a prometheus scraper
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	WriteMetrics(bw)
+	bw.Flush()
+}
+
+// labelSet is the values of a metric's labels joined into a map key
+type labelSet struct {
+	key    string
+	values []string
+}
+
+func newLabelSet(names, values []string) labelSet {
+	if len(values) != len(names) {
+		Logger.Errorf("metric with labels %v given values %v", names, values)
+		values = append(values, make([]string, len(names))...)[:len(names)]
+	}
+	return labelSet{key: strings.Join(values, "\xff"), values: values}
+}
+
+// formatLabels renders the labels, plus an optional extra one, as {a="b",...}
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing metric partitioned by labels
+type Counter struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+	sets       map[string]labelSet
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]float64{}, sets: map[string]labelSet{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	set := newLabelSet(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[set.key] += v
+	c.sets[set.key] = set
+}
+
+func (c *Counter) metricName() string { return c.name }
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.sets) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.sets[key].values, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets partitioned by
+// labels
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	set    labelSet
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram, using DefaultBuckets
+// when buckets is nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+// Observe records v for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	set := newLabelSet(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[set.key]
+	if !ok {
+		s = &histogramSeries{set: set, counts: make([]uint64, len(h.buckets))}
+		h.series[set.key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince records the seconds passed since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) metricName() string { return h.name }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.set.values, "le", formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.set.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.set.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.set.values, "", ""), s.count)
+	}
+}
+
+func sortedKeys(sets map[string]labelSet) []string {
+	keys := make([]string, 0, len(sets))
+	for key := range sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	backendCalls = NewCounter("backend_calls_total",
+		"Calls made to a backend service.", "backend", "op", "outcome")
+	backendLatency = NewHistogram("backend_call_duration_seconds",
+		"Latency of calls made to a backend service.", nil, "backend", "op")
+)
+
+// ObserveCall records a backend call that started at start. It is meant to
+// be deferred with a pointer to the named error result of the call.
+func ObserveCall(backend, op string, start time.Time, err *error) {
+	outcome := "ok"
+	if err != nil && *err != nil {
+		outcome = "error"
+	}
+	backendCalls.Inc(backend, op, outcome)
+	backendLatency.ObserveSince(start, backend, op)
+}
+
+// DefaultMetricsAddr is the platform assigned PORT when there is one,
+// otherwise fallback
+func DefaultMetricsAddr(fallback string) string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return fallback
+}
+
+// ServeMetrics serves /metrics on addr in the background, for the workers
+// that have no web server of their own
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", MetricsHandler)
+	go func() {
+		Logger.Infof("serving metrics at http://%s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			Logger.Error("metrics listener stopped: ", err)
+		}
+	}()
+}
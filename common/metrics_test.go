@@ -0,0 +1,79 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(m metric) string {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := &Counter{name: "test_total", help: "Test.", labels: []string{"a", "b"}, values: map[string]float64{}, sets: map[string]labelSet{}}
+	c.Inc("x", "y")
+	c.Add(2.5, "x", "y")
+	c.Inc("q\"uote\\", "new\nline")
+	// a missing value is padded rather than shifting the others
+	c.Inc("z")
+	want := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{a="q\"uote\\",b="new\nline"} 1
+test_total{a="x",b="y"} 3.5
+test_total{a="z",b=""} 1
+`
+	if got := write(c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{name: "test_seconds", help: "Test.", buckets: []float64{.1, 1}, series: map[string]*histogramSeries{}}
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(2)
+	want := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`
+	if got := write(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestObserveCall(t *testing.T) {
+	call := func(fail bool) (err error) {
+		defer ObserveCall("testdb", "Get", time.Now(), &err)
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	call(false)
+	call(true)
+	call(true)
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`backend_calls_total{backend="testdb",op="Get",outcome="ok"} 1`,
+		`backend_calls_total{backend="testdb",op="Get",outcome="error"} 2`,
+		`backend_call_duration_seconds_count{backend="testdb",op="Get"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if strings.Index(out, "# TYPE backend_call_duration_seconds") > strings.Index(out, "# TYPE backend_calls_total") {
+		t.Error("metrics are not sorted by name")
+	}
+}
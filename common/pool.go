@@ -0,0 +1,9 @@
+package common
+
+var (
+	// PoolSize is the most connections a backend client keeps open
+	PoolSize = 10
+
+	// PoolIdle is the most idle connections a backend client keeps around
+	PoolIdle = 2
+)
@@ -0,0 +1,275 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Service is a single bound service instance from VCAP_SERVICES
+type Service struct {
+	Name        string                 `json:"name"`
+	Label       string                 `json:"label"`
+	Plan        string                 `json:"plan"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// Services maps a service label to the instances bound under it
+type Services map[string][]Service
+
+// ParseServices reads a VCAP_SERVICES shaped json document
+func ParseServices(data []byte) (Services, error) {
+	var services Services
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("could not parse services: %s", err)
+	}
+	return services, nil
+}
+
+// ServicesFile is a VCAP_SERVICES shaped json or yaml file, or the name of
+// a built-in profile such as "dev", used when VCAP_SERVICES is not set
+var ServicesFile = os.Getenv("SERVICES_FILE")
+
+// LoadServices reads VCAP_SERVICES from the environment, falling back to
+// ServicesFile when the variable is not set
+func LoadServices() (Services, error) {
+	if vcap := os.Getenv("VCAP_SERVICES"); vcap != "" {
+		return ParseServices([]byte(vcap))
+	}
+	if ServicesFile == "" {
+		return Services{}, nil
+	}
+	return ParseServicesFile(ServicesFile)
+}
+
+// ParseServicesFile reads services from a built-in profile name or from a
+// json or yaml file
+func ParseServicesFile(path string) (Services, error) {
+	if profile, ok := profiles[path]; ok {
+		services, err := ParseServices([]byte(profile))
+		if err != nil {
+			return nil, err
+		}
+		services.expandEnv()
+		return services, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read services file: %s", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		doc, err := ParseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse services file %s: %s", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("could not parse services file %s: %s", path, err)
+		}
+	}
+	return ParseServices(data)
+}
+
+// expandEnv expands ${VAR} references in the credentials once they are
+// decoded, so a value with quotes in it cannot break the document.
+// Credentials holding a json document of their own are expanded inside it.
+func (s Services) expandEnv() {
+	for _, instances := range s {
+		for _, svc := range instances {
+			for key, value := range svc.Credentials {
+				svc.Credentials[key] = expandEnvIn(value)
+			}
+		}
+	}
+}
+
+func expandEnvIn(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		var doc map[string]interface{}
+		if strings.HasPrefix(v, "{") && json.Unmarshal([]byte(v), &doc) == nil {
+			if data, err := json.Marshal(expandEnvIn(doc)); err == nil {
+				return string(data)
+			}
+		}
+		return os.ExpandEnv(v)
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = expandEnvIn(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = expandEnvIn(value)
+		}
+	}
+	return v
+}
+
+// FindService loads the bound services and looks up key in them
+func FindService(key string) (*Service, error) {
+	services, err := LoadServices()
+	if err != nil {
+		return nil, err
+	}
+	return services.Find(key)
+}
+
+// Find looks up a service by instance name, then label, then tag
+func (s Services) Find(key string) (*Service, error) {
+	for _, instances := range s {
+		for i := range instances {
+			if strings.EqualFold(instances[i].Name, key) {
+				return &instances[i], nil
+			}
+		}
+	}
+	for label, instances := range s {
+		for i := range instances {
+			if strings.EqualFold(label, key) || strings.EqualFold(instances[i].Label, key) {
+				return &instances[i], nil
+			}
+		}
+	}
+	for _, instances := range s {
+		for i := range instances {
+			for _, tag := range instances[i].Tags {
+				if strings.EqualFold(tag, key) {
+					return &instances[i], nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no service bound with name, label or tag %q", key)
+}
+
+// Credential returns the first of keys present in the credentials as a string
+func (s *Service) Credential(keys ...string) (string, bool) {
+	for _, key := range keys {
+		switch v := s.Credentials[key].(type) {
+		case string:
+			if v != "" {
+				return v, true
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	}
+	return "", false
+}
+
+// URI returns the connection uri of the service, if one was given
+func (s *Service) URI() string {
+	uri, _ := s.Credential("uri", "url")
+	return uri
+}
+
+// parsedURI returns the parsed connection uri or nil. A jdbcUrl is used
+// when there is no uri, with its user and password query parameters moved
+// into the userinfo.
+func (s *Service) parsedURI() *url.URL {
+	uri := s.URI()
+	jdbc := false
+	if uri == "" {
+		uri, jdbc = s.jdbcURL(), true
+	}
+	if uri == "" {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		Logger.Warnf("could not parse uri for service %s: %s", s.Name, err)
+		return nil
+	}
+	if jdbc && u.User == nil {
+		q := u.Query()
+		if user := q.Get("user"); user != "" {
+			u.User = url.UserPassword(user, q.Get("password"))
+		}
+	}
+	return u
+}
+
+func (s *Service) jdbcURL() string {
+	jdbc, _ := s.Credential("jdbcUrl", "jdbc_url")
+	return strings.TrimPrefix(jdbc, "jdbc:")
+}
+
+// Host returns the hostname of the service, preferring the uri
+func (s *Service) Host() string {
+	if u := s.parsedURI(); u != nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	host, _ := s.Credential("host", "hostname")
+	return host
+}
+
+// Port returns the port of the service, preferring the uri
+func (s *Service) Port() string {
+	if u := s.parsedURI(); u != nil && u.Port() != "" {
+		return u.Port()
+	}
+	port, _ := s.Credential("port")
+	return port
+}
+
+// HostPort returns host:port of the service, using defaultPort when no port
+// was given
+func (s *Service) HostPort(defaultPort string) string {
+	port := s.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(s.Host(), port)
+}
+
+// Username returns the user to connect to the service as, preferring the uri
+func (s *Service) Username() string {
+	if u := s.parsedURI(); u != nil && u.User != nil && u.User.Username() != "" {
+		return u.User.Username()
+	}
+	user, _ := s.Credential("username", "user")
+	return user
+}
+
+// Password returns the password to connect to the service with, preferring
+// the uri
+func (s *Service) Password() string {
+	if u := s.parsedURI(); u != nil && u.User != nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			return password
+		}
+	}
+	password, _ := s.Credential("password")
+	return password
+}
+
+// Database returns the database name of the service, preferring the uri
+func (s *Service) Database() string {
+	if u := s.parsedURI(); u != nil {
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			return db
+		}
+	}
+	db, _ := s.Credential("database", "db", "dbname", "name")
+	return db
+}
+
+// Option returns a connection option from the uri query string, falling back
+// to a credential of the same name
+func (s *Service) Option(key string) (string, bool) {
+	if u := s.parsedURI(); u != nil {
+		if v := u.Query().Get(key); v != "" {
+			return v, true
+		}
+	}
+	return s.Credential(key)
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want interface{}
+	}{
+		{"empty", "", nil},
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: x\n", map[string]interface{}{
+			"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}, "d": "x"},
+		}},
+		{"quoting", "a: \"x: y # z\"\nb: 'it''s'\nc: \"3\"\n", map[string]interface{}{
+			"a": "x: y # z", "b": "it's", "c": "3",
+		}},
+		{"lists", "tags:\n  - mysql\n  - relational\nflow: [a, b]\n", map[string]interface{}{
+			"tags": []interface{}{"mysql", "relational"}, "flow": []interface{}{"a", "b"},
+		}},
+		{"list of mappings", "- name: a\n  port: 1\n- name: b\n", []interface{}{
+			map[string]interface{}{"name": "a", "port": 1},
+			map[string]interface{}{"name": "b"},
+		}},
+		{"comments", "# header\na: 1 # trailing\n# between\nb: \"#not\"\n", map[string]interface{}{
+			"a": 1, "b": "#not",
+		}},
+		{"non string keys", "1: one\ntrue: yes\n", map[string]interface{}{"1": "one", "true": true}},
+	}
+	for _, tt := range tests {
+		got, err := ParseYAML([]byte(tt.yaml))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("%s: not json compatible: %s", tt.name, err)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, doc := range []string{"a:\n\t- b\n", "a: [b\n", "a: 1\n a: 2\n"} {
+		if _, err := ParseYAML([]byte(doc)); err == nil {
+			t.Errorf("%q: expected an error", doc)
+		}
+	}
+}
+
+func TestParseServicesFileYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yml")
+	doc := `
+cp16net-redis:
+  - name: cp16net-redis
+    label: redis
+    tags: [redis]
+    credentials:
+      hostname: localhost
+      port: 6379
+      password: "p@ss: word"
+`
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	services, err := ParseServicesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := services.Find("redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.HostPort("1"); got != "localhost:6379" {
+		t.Errorf("host port: got %q", got)
+	}
+	if got := svc.Password(); got != "p@ss: word" {
+		t.Errorf("password: got %q", got)
+	}
+}
+
+func TestProfileExpandsQuotes(t *testing.T) {
+	defer os.Setenv("HODKEY", os.Getenv("HODKEY"))
+	defer os.Setenv("GOOGLE_API_KEY", os.Getenv("GOOGLE_API_KEY"))
+	os.Setenv("HODKEY", `a"b\c`)
+	os.Setenv("GOOGLE_API_KEY", `x"}y`)
+	services, err := ParseServicesFile("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hod, err := services.Find("cp16net-hod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := hod.Credential("HOD_API_KEY"); key != `a"b\c` {
+		t.Errorf("HOD_API_KEY: got %q", key)
+	}
+	google, err := services.Find("cp16net-googleapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passthrough, _ := google.Credential("PASSTHROUGH_DATA")
+	var data map[string]string
+	if err := json.Unmarshal([]byte(passthrough), &data); err != nil {
+		t.Fatalf("PASSTHROUGH_DATA %q: %s", passthrough, err)
+	}
+	if data["google_api_key"] != `x"}y` {
+		t.Errorf("google_api_key: got %q", data["google_api_key"])
+	}
+}
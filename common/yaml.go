@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ParseYAML decodes a yaml document into plain maps, slices and scalars
+// that can be re-encoded as json
+func ParseYAML(data []byte) (interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return jsonValue(doc), nil
+}
+
+// jsonValue turns the map[interface{}]interface{} yaml decodes mappings
+// into, at any depth, into the string keyed maps json expects
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+	}
+	return v
+}
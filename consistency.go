@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// timestampPrecision is how far apart timestamps may be and still match,
+// mysql rounds to whole seconds where postgres keeps microseconds
+const timestampPrecision = time.Second
+
+// UserMismatch is a user that several backends have, with different values
+type UserMismatch struct {
+	Email  string                 `json:"email"`
+	Fields []string               `json:"fields"`
+	Users  map[string]models.User `json:"users"`
+}
+
+// ConsistencyReport compares the users of the sql backends by email
+type ConsistencyReport struct {
+	Backends   []string                 `json:"backends"`
+	Matched    int                      `json:"matched"`
+	Missing    map[string][]models.User `json:"missing"`
+	Mismatched []UserMismatch           `json:"mismatched"`
+	Errors     map[string]string        `json:"errors,omitempty"`
+}
+
+// Consistent reports whether the backends hold the same users
+func (r ConsistencyReport) Consistent() bool {
+	if len(r.Errors) > 0 || len(r.Mismatched) > 0 {
+		return false
+	}
+	for _, users := range r.Missing {
+		if len(users) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < timestampPrecision && d > -timestampPrecision
+}
+
+func sameDeletedAt(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return sameTime(*a, *b)
+}
+
+// userDifferences names the fields that differ between two copies of a
+// user. Passwords are not compared, each backend hashed the plaintext
+// passwords of its legacy rows with a salt of its own.
+func userDifferences(a, b models.User) []string {
+	var fields []string
+	if a.Username != b.Username {
+		fields = append(fields, "username")
+	}
+	if !sameTime(a.CreatedAt, b.CreatedAt) {
+		fields = append(fields, "created_at")
+	}
+	if !sameTime(a.UpdatedAt, b.UpdatedAt) {
+		fields = append(fields, "updated_at")
+	}
+	if !sameDeletedAt(a.DeletedAt, b.DeletedAt) {
+		fields = append(fields, "deleted_at")
+	}
+	return fields
+}
+
+// compareUsers diffs the users of the backends by email. Every copy of a
+// user is compared with the copy in the first backend that has it, the
+// primary when it does.
+func compareUsers(names []string, users map[string][]models.User) ConsistencyReport {
+	report := ConsistencyReport{Backends: names, Missing: map[string][]models.User{}}
+	byEmail := map[string]map[string]models.User{}
+	var emails []string
+	for _, name := range names {
+		report.Missing[name] = []models.User{}
+		for _, user := range users[name] {
+			if byEmail[user.Email] == nil {
+				byEmail[user.Email] = map[string]models.User{}
+				emails = append(emails, user.Email)
+			}
+			byEmail[user.Email][name] = user
+		}
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		copies := byEmail[email]
+		var reference string
+		for _, name := range names {
+			if _, ok := copies[name]; ok {
+				reference = name
+				break
+			}
+		}
+		mismatch := UserMismatch{Email: email, Users: map[string]models.User{reference: copies[reference]}}
+		seen := map[string]bool{}
+		for _, name := range names {
+			user, ok := copies[name]
+			if !ok {
+				report.Missing[name] = append(report.Missing[name], copies[reference])
+				continue
+			}
+			fields := userDifferences(copies[reference], user)
+			if len(fields) > 0 {
+				mismatch.Users[name] = user
+			}
+			for _, field := range fields {
+				if !seen[field] {
+					seen[field] = true
+					mismatch.Fields = append(mismatch.Fields, field)
+				}
+			}
+		}
+		if len(mismatch.Fields) > 0 {
+			report.Mismatched = append(report.Mismatched, mismatch)
+		} else if len(copies) == len(names) {
+			report.Matched++
+		}
+	}
+	return report
+}
+
+// maxConsistencyUsers is the most users loaded from each backend for a
+// comparison, larger tables are not compared at all
+const maxConsistencyUsers = 10000
+
+// checkConsistency loads every user of each sql backend and compares them
+func checkConsistency() ConsistencyReport {
+	if len(sqlBackendNames) < 2 {
+		return ConsistencyReport{
+			Backends: sqlBackendNames,
+			Errors:   map[string]string{"sql": "two sql backends have to be enabled to compare them"},
+		}
+	}
+	users := map[string][]models.User{}
+	errs := map[string]string{}
+	for _, name := range sqlBackendNames {
+		var err error
+		users[name], err = sqlBackends[name].AllUsers(maxConsistencyUsers)
+		switch {
+		case err == store.ErrTooManyUsers:
+			errs[name] = fmt.Sprintf("more than %d users, too many to compare", maxConsistencyUsers)
+		case err != nil:
+			errs[name] = err.Error()
+		}
+	}
+	if len(errs) > 0 {
+		return ConsistencyReport{Backends: sqlBackendNames, Errors: errs}
+	}
+	return compareUsers(sqlBackendNames, users)
+}
+
+// ReconcileResult lists the users copied into each backend
+type ReconcileResult struct {
+	Copied map[string][]models.User `json:"copied"`
+	Errors []string                 `json:"errors,omitempty"`
+}
+
+// reconcile copies the users missing from the to backend, an empty to
+// fills in every backend. Mismatched users are left alone.
+func reconcile(to string) (ReconcileResult, error) {
+	result := ReconcileResult{Copied: map[string][]models.User{}}
+	if to != "" {
+		if _, ok := sqlBackends[to]; !ok {
+			return result, fmt.Errorf("unknown sql backend %q", to)
+		}
+	}
+	report := checkConsistency()
+	if len(report.Errors) > 0 {
+		for name, err := range report.Errors {
+			result.Errors = append(result.Errors, name+": "+err)
+		}
+		sort.Strings(result.Errors)
+		return result, fmt.Errorf("cannot reconcile: %v", result.Errors)
+	}
+	for _, name := range report.Backends {
+		if to != "" && name != to {
+			continue
+		}
+		for _, user := range report.Missing[name] {
+			copied, err := sqlBackends[name].CopyUser(user)
+			if err != nil {
+				common.Logger.Errorf("could not copy %s into %s: %s", user.Email, name, err)
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %s: %s", name, user.Email, err))
+				continue
+			}
+			result.Copied[name] = append(result.Copied[name], copied)
+		}
+	}
+	return result, nil
+}
+
+// ConsistencyData for the consistency page
+type ConsistencyData struct {
+	Report    ConsistencyReport
+	Reconcile *ReconcileResult
+}
+
+func consistencyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	renderTemplate(w, "templates/consistency.html", ConsistencyData{Report: checkConsistency()})
+}
+
+func reconcileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	result, err := reconcile(r.PostFormValue("to"))
+	if err != nil {
+		renderUnavailable(w, "SQL", err)
+		return
+	}
+	renderTemplate(w, "templates/consistency.html", ConsistencyData{Report: checkConsistency(), Reconcile: &result})
+}
+
+// apiConsistencyHandler answers 200 when the backends agree and 409 when
+// they do not
+func apiConsistencyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report := checkConsistency()
+	status := http.StatusOK
+	switch {
+	case len(report.Errors) > 0:
+		status = http.StatusServiceUnavailable
+	case !report.Consistent():
+		status = http.StatusConflict
+	}
+	renderJSON(w, status, report)
+}
+
+// APIReconcileRequest picks the backend to copy missing users into, every
+// backend is filled in when To is empty
+type APIReconcileRequest struct {
+	To string `json:"to"`
+}
+
+func apiReconcileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APIReconcileRequest{}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &body); err != nil {
+			renderAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if body.To != "" {
+		if _, ok := sqlBackends[body.To]; !ok {
+			renderAPIError(w, http.StatusBadRequest, fmt.Errorf("unknown sql backend %q", body.To))
+			return
+		}
+	}
+	result, err := reconcile(body.To)
+	if err != nil {
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	status := http.StatusOK
+	if len(result.Errors) > 0 {
+		status = http.StatusMultiStatus
+	}
+	renderJSON(w, status, result)
+}
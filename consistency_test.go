@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+)
+
+func TestCompareUsers(t *testing.T) {
+	created := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	user := func(username, email, password string) models.User {
+		u := models.User{Username: username, Email: email, Password: password}
+		u.CreatedAt, u.UpdatedAt = created, created
+		return u
+	}
+	names := []string{"mysql", "postgres", "sqlite"}
+	report := compareUsers(names, map[string][]models.User{
+		// every backend salted its own hash of ann's legacy password
+		"mysql":    {user("ann", "ann@x.io", "$2a$one"), user("bob", "bob@x.io", "h")},
+		"postgres": {user("ann", "ann@x.io", "$2a$two"), user("bobby", "bob@x.io", "h")},
+		"sqlite":   {user("ann", "ann@x.io", "$2a$three"), user("cat", "cat@x.io", "h")},
+	})
+
+	if report.Matched != 1 {
+		t.Errorf("matched %d, want ann alone", report.Matched)
+	}
+	if len(report.Mismatched) != 1 || report.Mismatched[0].Email != "bob@x.io" ||
+		len(report.Mismatched[0].Fields) != 1 || report.Mismatched[0].Fields[0] != "username" {
+		t.Fatalf("mismatched: %+v", report.Mismatched)
+	}
+	if _, ok := report.Mismatched[0].Users["postgres"]; !ok {
+		t.Error("the differing copy is not listed")
+	}
+	// sqlite lacks bob, and only sqlite has cat
+	missing := func(name string) (emails []string) {
+		for _, u := range report.Missing[name] {
+			emails = append(emails, u.Email)
+		}
+		return emails
+	}
+	if got := missing("sqlite"); len(got) != 1 || got[0] != "bob@x.io" {
+		t.Errorf("missing from sqlite: %v", got)
+	}
+	if got := missing("mysql"); len(got) != 1 || got[0] != "cat@x.io" {
+		t.Errorf("missing from mysql: %v", got)
+	}
+	if report.Consistent() {
+		t.Error("the report says the backends are consistent")
+	}
+}
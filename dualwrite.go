@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/outbox"
+)
+
+// primarySQLBackend takes the generated users first, the other backends
+// get them from its outbox
+func primarySQLBackend() string {
+	return sqlBackendNames[0]
+}
+
+// userRelay copies the generated users from the primary outbox to the
+// other sql backends, retrying until they take them
+var userRelay = &outbox.Relay{
+	Store: func() (*outbox.Store, error) {
+		return sqlBackends[primarySQLBackend()].Outbox()
+	},
+	Deliver:   deliverUser,
+	Interval:  5 * time.Second,
+	BatchSize: 50,
+	// the listings were cached without the copies and with the entries
+	// still pending
+	AfterDelivery: func() { invalidate(usersCache) },
+}
+
+// deliverUser copies the user into the target unless it already has it
+func deliverUser(target string, user models.User) error {
+	backend, ok := sqlBackends[target]
+	if !ok {
+		return fmt.Errorf("unknown sql backend %q", target)
+	}
+	_, err := backend.UserByEmail(user.Email)
+	if err == nil {
+		return nil
+	}
+	if err != models.ErrUserNotFound {
+		return err
+	}
+	_, err = backend.CopyUser(user)
+	return err
+}
+
+// GeneratedUser is a user written to the primary backend and queued for
+// the others
+type GeneratedUser struct {
+	Backend string      `json:"backend"`
+	User    models.User `json:"user"`
+	Queued  []string    `json:"queued"`
+}
+
+// generateUser writes one random user to the primary backend together
+// with an outbox entry for each other backend, then kicks the relay
+func generateUser() (GeneratedUser, error) {
+	primary := primarySQLBackend()
+	result := GeneratedUser{Backend: primary, Queued: sqlBackendNames[1:]}
+	user, err := models.RandomUser()
+	if err != nil {
+		return result, err
+	}
+	result.User, err = sqlBackends[primary].CreateUserWithOutbox(user, result.Queued)
+	if err != nil {
+		return result, err
+	}
+	userRelay.Kick()
+	return result, nil
+}
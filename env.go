@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/julienschmidt/httprouter"
+)
+
+// masked replaces every value that is hidden
+const masked = "********"
+
+// EnvVar is a single environment variable
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Masked bool   `json:"masked,omitempty"`
+}
+
+// EnvNode is one value of a json document, with Children for objects and
+// arrays
+type EnvNode struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value,omitempty"`
+	Masked   bool      `json:"masked,omitempty"`
+	Children []EnvNode `json:"children,omitempty"`
+}
+
+// EnvData for the env page
+type EnvData struct {
+	Revealed    bool      `json:"revealed"`
+	Application []EnvNode `json:"application"`
+	Platform    []EnvVar  `json:"platform"`
+	Services    []EnvNode `json:"services"`
+	Other       []EnvVar  `json:"other"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// platformVars are shown apart from the rest of the environment, along
+// with every CF_INSTANCE_ variable
+var platformVars = map[string]bool{
+	"PORT":             true,
+	"VCAP_APP_HOST":    true,
+	"VCAP_APP_PORT":    true,
+	"VCAP_APPLICATION": true,
+	"INSTANCE_GUID":    true,
+	"INSTANCE_INDEX":   true,
+	"MEMORY_LIMIT":     true,
+	"CF_STACK":         true,
+}
+
+func isPlatformVar(name string) bool {
+	return platformVars[name] || strings.HasPrefix(name, "CF_INSTANCE_")
+}
+
+// secretWords in a name mark its value as a secret
+var secretWords = []string{"PASS", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "AUTH", "PRIVATE", "CERT"}
+
+func isSecretName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, word := range secretWords {
+		if strings.Contains(upper, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicCredentials are the credential keys shown without revealing
+var publicCredentials = map[string]bool{
+	"host": true, "hostname": true, "port": true, "name": true, "db": true,
+	"database": true, "dbname": true, "vhost": true, "username": true, "user": true,
+	"uri": true, "url": true, "jdbcUrl": true, "jdbc_url": true,
+}
+
+// uriCredentials are the public credentials holding a uri, they are shown
+// with its password and secret options hidden
+var uriCredentials = map[string]bool{"uri": true, "url": true, "jdbcUrl": true, "jdbc_url": true}
+
+// redactURI hides the password and secret query options, like password=,
+// of a uri. jdbc: urls are read as the uri after the prefix. ok is false
+// when the value is not a uri with a host, it is returned unchanged then.
+func redactURI(value string) (redacted string, ok bool) {
+	prefix, rest := "", value
+	if strings.HasPrefix(strings.ToLower(value), "jdbc:") {
+		prefix, rest = value[:len("jdbc:")], value[len("jdbc:"):]
+	}
+	u, err := url.Parse(rest)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value, false
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), masked)
+		changed = true
+	}
+	q := u.Query()
+	for key := range q {
+		if isSecretName(key) {
+			q.Set(key, masked)
+			changed = true
+		}
+	}
+	if !changed {
+		return value, true
+	}
+	u.RawQuery = q.Encode()
+	// url escapes the * of the mask in the user info and query
+	return prefix + strings.Replace(u.String(), "%2A", "*", -1), true
+}
+
+// maskVar hides the value of a variable that looks like a secret
+func maskVar(name, value string) EnvVar {
+	if isSecretName(name) {
+		return EnvVar{Name: name, Value: masked, Masked: true}
+	}
+	if redacted, _ := redactURI(value); redacted != value {
+		return EnvVar{Name: name, Value: redacted, Masked: true}
+	}
+	return EnvVar{Name: name, Value: value}
+}
+
+// envTree turns a decoded json value into nodes, hiding every value when
+// mask is set except the keys allowed by public
+func envTree(key string, v interface{}, mask bool, public map[string]bool) EnvNode {
+	node := EnvNode{Key: key}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			node.Children = append(node.Children, envTree(k, v[k], mask, public))
+		}
+	case []interface{}:
+		for i, item := range v {
+			node.Children = append(node.Children, envTree(fmt.Sprintf("[%d]", i), item, mask, public))
+		}
+	case nil:
+		node.Value = "null"
+	default:
+		node.Value = fmt.Sprint(v)
+		if !mask {
+			break
+		}
+		if public[key] && !isSecretName(key) {
+			if !uriCredentials[key] || node.Value == "" {
+				break
+			}
+			// a uri that cannot be read may hold a password anywhere
+			if redacted, ok := redactURI(node.Value); !ok || redacted != node.Value {
+				node.Value, node.Masked = masked, true
+				if ok {
+					node.Value = redacted
+				}
+			}
+			break
+		}
+		node.Value, node.Masked = masked, true
+	}
+	return node
+}
+
+// serviceTree renders the bound services, masking their credentials
+func serviceTree(services common.Services, mask bool) []EnvNode {
+	labels := make([]string, 0, len(services))
+	for label := range services {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	var nodes []EnvNode
+	for _, label := range labels {
+		node := EnvNode{Key: label}
+		for _, svc := range services[label] {
+			child := EnvNode{Key: svc.Name, Children: []EnvNode{
+				{Key: "label", Value: svc.Label},
+				{Key: "plan", Value: svc.Plan},
+				{Key: "tags", Value: strings.Join(svc.Tags, ", ")},
+			}}
+			creds := envTree("credentials", toJSONValue(svc.Credentials), mask, publicCredentials)
+			child.Children = append(child.Children, creds)
+			node.Children = append(node.Children, child)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// toJSONValue converts v to the generic form json.Unmarshal produces, so the
+// tree only has to handle maps, slices and scalars
+func toJSONValue(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// loadEnv gathers the environment, with secrets masked unless reveal is set
+func loadEnv(reveal bool) EnvData {
+	data := EnvData{Revealed: reveal}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		name, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch {
+		case name == "VCAP_SERVICES":
+			// shown parsed as the services tree
+		case name == "VCAP_APPLICATION":
+			var app interface{}
+			if err := json.Unmarshal([]byte(value), &app); err != nil {
+				data.Platform = append(data.Platform, maskVar(name, value))
+				continue
+			}
+			data.Application = envTree(name, app, false, nil).Children
+		case reveal:
+			v := EnvVar{Name: name, Value: value}
+			if isPlatformVar(name) {
+				data.Platform = append(data.Platform, v)
+			} else {
+				data.Other = append(data.Other, v)
+			}
+		case isPlatformVar(name):
+			data.Platform = append(data.Platform, maskVar(name, value))
+		default:
+			data.Other = append(data.Other, maskVar(name, value))
+		}
+	}
+	sort.Slice(data.Platform, func(i, j int) bool { return data.Platform[i].Name < data.Platform[j].Name })
+	sort.Slice(data.Other, func(i, j int) bool { return data.Other[i].Name < data.Other[j].Name })
+
+	services, err := common.LoadServices()
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Services = serviceTree(services, !reveal)
+	return data
+}
+
+var (
+	errRevealDisabled = errors.New("revealing secrets is disabled, set ADMIN_TOKEN to enable it")
+	errRevealDenied   = errors.New("the admin token is required to reveal secrets")
+)
+
+// authorizeReveal checks the admin token, given as the basic auth password
+// or in the X-Admin-Token header
+func authorizeReveal(r *http.Request) error {
+	if AppConfig.AdminToken == "" {
+		return errRevealDisabled
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(AppConfig.AdminToken)) != 1 {
+		return errRevealDenied
+	}
+	return nil
+}
+
+// revealRequest resolves whether the secrets the request asks for with
+// param=true, in the query or a form, may be shown, answering 401 or 403 itself when they may not
+func revealRequest(w http.ResponseWriter, r *http.Request, param string, render func(int, error)) (reveal bool, ok bool) {
+	if r.FormValue(param) != "true" {
+		return false, true
+	}
+	switch err := authorizeReveal(r); err {
+	case nil:
+		common.Logger.Warnf("%s %s with %s=true allowed for %s", r.Method, r.URL.Path, param, r.RemoteAddr)
+		return true, true
+	case errRevealDisabled:
+		render(http.StatusForbidden, err)
+	default:
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		render(http.StatusUnauthorized, err)
+	}
+	return false, false
+}
+
+func envHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reveal, ok := revealRequest(w, r, "reveal", func(status int, err error) {
+		http.Error(w, err.Error(), status)
+	})
+	if !ok {
+		return
+	}
+	renderTemplate(w, "templates/env.html", loadEnv(reveal))
+}
+
+func apiEnvHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reveal, ok := revealRequest(w, r, "reveal", func(status int, err error) {
+		renderAPIError(w, status, err)
+	})
+	if !ok {
+		return
+	}
+	renderJSON(w, http.StatusOK, loadEnv(reveal))
+}
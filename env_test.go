@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactURI(t *testing.T) {
+	tests := []struct {
+		value, want string
+		ok          bool
+	}{
+		{"mysql://u:p@h:3306/db", "mysql://u:********@h:3306/db", true},
+		{"postgres://h/db?sslmode=require", "postgres://h/db?sslmode=require", true},
+		{"jdbc:mysql://h:3306/db?user=u&password=p", "jdbc:mysql://h:3306/db?password=********&user=u", true},
+		{"jdbc:postgresql://u:p@h/db", "jdbc:postgresql://u:********@h/db", true},
+		{"jdbc:oracle:thin:u/p@h:1521:db", "jdbc:oracle:thin:u/p@h:1521:db", false},
+		{"not a uri", "not a uri", false},
+	}
+	for _, tt := range tests {
+		got, ok := redactURI(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("redactURI(%q) = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestEnvTreeMasksCredentials(t *testing.T) {
+	creds := map[string]interface{}{
+		"hostname": "h",
+		"password": "p",
+		"jdbcUrl":  "jdbc:mysql://h:3306/db?user=u&password=p",
+		"uri":      "jdbc:oracle:thin:u/p@h:1521:db",
+	}
+	tree := envTree("credentials", creds, true, publicCredentials)
+	values := map[string]string{}
+	for _, node := range tree.Children {
+		values[node.Key] = node.Value
+	}
+	if values["hostname"] != "h" {
+		t.Errorf("hostname is hidden: %q", values["hostname"])
+	}
+	for key, value := range values {
+		if strings.Contains(value, "=p") || strings.Contains(value, "/p@") || value == "p" {
+			t.Errorf("%s shows the password: %q", key, value)
+		}
+	}
+}
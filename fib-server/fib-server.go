@@ -1,10 +1,10 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"strconv"
 
-	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/streadway/amqp"
 
 	"github.com/cp16net/hod-test-app/common"
@@ -26,16 +26,27 @@ func fib(n int) int {
 	}
 }
 
-func main() {
-	appEnv, _ := cfenv.Current()
-	svcRabbitmq, err := appEnv.Services.WithName("cp16net-rabbitmq")
-	if err != nil {
-		panic("failed to get the cp16net-rabbitmq service details")
-	}
+var (
+	consumed = common.NewCounter("messages_consumed_total",
+		"Messages consumed from rabbitmq.", "queue")
+	published = common.NewCounter("messages_published_total",
+		"Messages published to rabbitmq.", "queue")
+)
 
-	uri, ok := svcRabbitmq.CredentialString("uri")
-	if !ok {
-		panic("failed to get the credential uri for rabbitmq")
+func main() {
+	flag.StringVar(&common.ServicesFile, "services-file", common.ServicesFile,
+		"VCAP_SERVICES json or yaml file, or built-in profile (dev), used when VCAP_SERVICES is unset (env SERVICES_FILE)")
+	metricsAddr := flag.String("metrics-addr", common.DefaultMetricsAddr(":9090"),
+		"address to serve /metrics on (defaults to :$PORT when set)")
+	flag.Parse()
+	common.ServeMetrics(*metricsAddr)
+
+	svcRabbitmq, err := common.FindService("cp16net-rabbitmq")
+	failOnError(err, "Failed to get the cp16net-rabbitmq service details")
+
+	uri := svcRabbitmq.URI()
+	if uri == "" {
+		log.Fatal("failed to get the credential uri for rabbitmq")
 	}
 
 	conn, err := amqp.Dial(uri)
@@ -77,6 +88,7 @@ func main() {
 
 	go func() {
 		for d := range msgs {
+			consumed.Inc(q.Name)
 			n, err := strconv.Atoi(string(d.Body))
 			failOnError(err, "Failed to convert body to integer")
 
@@ -94,6 +106,7 @@ func main() {
 					Body:          []byte(strconv.Itoa(response)),
 				})
 			failOnError(err, "Failed to publish a message")
+			published.Inc(d.ReplyTo)
 
 			d.Ack(true)
 		}
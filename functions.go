@@ -3,6 +3,8 @@ package main
 import (
 	"html/template"
 	"strings"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
 )
 
 var (
@@ -10,5 +12,11 @@ var (
 		"Upper": func(s string) string {
 			return strings.ToUpper(s)
 		},
+		"SortURL":      sortURL,
+		"PageURL":      pageURL,
+		"AuditPageURL": auditPageURL,
+		"RedisKeysURL": redisKeysURL,
+		"RedisKeyURL":  redisKeyURL,
+		"TimeFilter":   models.FormatTimeFilter,
 	}
 )
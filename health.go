@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/hod"
+	"github.com/cp16net/hod-test-app/mongo"
+	"github.com/cp16net/hod-test-app/rabbitmq"
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// healthCheck pings one backend
+type healthCheck struct {
+	Name string
+	Ping func() error
+}
+
+// CheckResult of a single backend ping
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthData for the health and ready endpoints
+type HealthData struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+var errCheckTimeout = errors.New("check timed out")
+
+// backendChecks are the backends every health report covers
+func backendChecks() []healthCheck {
+	var checks []healthCheck
+	for _, name := range sqlBackendNames {
+		checks = append(checks, healthCheck{name, sqlBackends[name].Ping})
+	}
+	return append(checks,
+		healthCheck{"redis", redis.Ping},
+		healthCheck{"rabbitmq", rabbitmq.Ping},
+		healthCheck{"mongo", mongo.Ping},
+	)
+}
+
+// pingCall is a ping of one backend that is running or finished
+type pingCall struct {
+	done chan struct{}
+	err  error
+}
+
+// pings are the pings that have not returned yet, by backend. A ping that
+// hangs past the timeout is not started again until it returns, so checks
+// of a backend that does not answer do not pile up.
+var pings = struct {
+	sync.Mutex
+	running map[string]*pingCall
+}{running: map[string]*pingCall{}}
+
+// startPing pings the backend, or joins the ping of it still running
+func startPing(check healthCheck) *pingCall {
+	pings.Lock()
+	defer pings.Unlock()
+	if call, ok := pings.running[check.Name]; ok {
+		return call
+	}
+	call := &pingCall{done: make(chan struct{})}
+	pings.running[check.Name] = call
+	go func() {
+		call.err = check.Ping()
+		pings.Lock()
+		delete(pings.running, check.Name)
+		pings.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// runChecks pings the backends concurrently, giving each one timeout
+func runChecks(checks []healthCheck, timeout time.Duration) HealthData {
+	data := HealthData{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			call := startPing(check)
+			var err error
+			select {
+			case <-call.done:
+				err = call.err
+			case <-time.After(timeout):
+				err = errCheckTimeout
+			}
+			result := CheckResult{Status: "ok", LatencyMS: float64(time.Since(start)) / float64(time.Millisecond)}
+			if err != nil {
+				result.Status, result.Error = "down", err.Error()
+			}
+			mu.Lock()
+			data.Checks[check.Name] = result
+			if err != nil {
+				data.Status = "degraded"
+			}
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+	return data
+}
+
+// checksFor the request, adding the havenondemand upstream when asked
+// for with ?hod=true
+func checksFor(r *http.Request) []healthCheck {
+	checks := backendChecks()
+	if r.URL.Query().Get("hod") == "true" {
+		checks = append(checks, healthCheck{"hod", func() error {
+			return hod.Ping(AppConfig.HealthTimeout)
+		}})
+	}
+	return checks
+}
+
+// healthHandler reports every backend but always answers 200 so the
+// platform does not restart the app because a backend is down
+func healthHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	renderJSON(w, http.StatusOK, runChecks(checksFor(r), AppConfig.HealthTimeout))
+}
+
+// readyHandler answers 503 when any backend is down
+func readyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := runChecks(checksFor(r), AppConfig.HealthTimeout)
+	status := http.StatusOK
+	if data.Status != "ok" {
+		status = http.StatusServiceUnavailable
+		var down []string
+		for name, result := range data.Checks {
+			if result.Status != "ok" {
+				down = append(down, name)
+			}
+		}
+		sort.Strings(down)
+		common.Logger.Warn("not ready, backends down: ", down)
+	}
+	renderJSON(w, status, data)
+}
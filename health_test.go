@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHungPingIsNotRepeated(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	hung := healthCheck{"hung", func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}}
+
+	for i := 0; i < 3; i++ {
+		data := runChecks([]healthCheck{hung}, 10*time.Millisecond)
+		if data.Checks["hung"].Error != errCheckTimeout.Error() {
+			t.Fatalf("check %d: got %+v", i, data.Checks["hung"])
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("pinged %d times while the first ping hung", n)
+	}
+
+	close(release)
+	// wait for the hung ping to return
+	<-startPing(hung).done
+	data := runChecks([]healthCheck{hung}, time.Second)
+	if data.Status != "ok" {
+		t.Errorf("after the ping returned: got %+v", data)
+	}
+}
@@ -3,107 +3,159 @@ package hod
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/cp16net/hod-test-app/common"
 	"github.com/julienschmidt/httprouter"
 )
 
-// Coordinate model
-type Coordinate struct {
-	Latitude string `json:"lat"`
-	Longitue string `json:"lng"`
-}
+// serviceName of the bound havenondemand service
+const serviceName = "cp16net-hod"
+
+// apiURL of the havenondemand coordinate lookup
+const apiURL = "https://api.havenondemand.com/1/api/sync/mapcoordinates/v1"
+
+// client of the lookups, a lookup that hangs fails instead of holding the
+// request
+var client = &http.Client{Timeout: 10 * time.Second}
 
-// Service Definition
-type Service struct {
-	HOD []HavenOnDemand `json:"cp16net-hod"`
+// apiKey resolves the havenondemand api key from the bound service
+func apiKey() (string, error) {
+	svc, err := common.FindService(serviceName)
+	if err != nil {
+		return "", err
+	}
+	key, ok := svc.Credential("HOD_API_KEY")
+	if !ok {
+		return "", fmt.Errorf("service %s has no HOD_API_KEY credential", serviceName)
+	}
+	return key, nil
 }
 
-// HavenOnDemand Service Info
-type HavenOnDemand struct {
-	Creds Credentials `json:"credentials"`
+// setup resolves the havenondemand binding the first time it is used
+var setup = common.NewLazy("havenondemand", func() error {
+	_, err := apiKey()
+	return err
+})
+
+// Ready resolves the havenondemand binding if needed and returns why it is
+// unavailable
+func Ready() error {
+	return setup.Ready()
 }
 
-// Credentials for HavenOnDemand
-type Credentials struct {
-	APIKey string `json:"HOD_API_KEY"`
+// Ping checks that the havenondemand api answers
+func Ping(timeout time.Duration) error {
+	if err := Ready(); err != nil {
+		return err
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Head(apiURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("havenondemand answered %s", resp.Status)
+	}
+	return nil
 }
 
-var envVcapServices = `
-{
-	"cp16net-hod": [
-		{
-			"credentials": {
-				"HOD_API_KEY": "{{.HodKey}}"
-			},
-			"syslog_drain_url": null,
-			"volume_mounts": [],
-			"label": "hod10",
-			"provider": null,
-			"plan": "default",
-			"name": "hod10",
-			"tags": [
-				"hod10"
-			]
-		}
-	]
-}`
+// ParseCoordinate reads a latitude and a longitude in degrees
+func ParseCoordinate(lat, lng string) (latitude, longitude float64, err error) {
+	latitude, err = strconv.ParseFloat(lat, 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return 0, 0, fmt.Errorf("latitude %q is not a number between -90 and 90", lat)
+	}
+	longitude, err = strconv.ParseFloat(lng, 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return 0, 0, fmt.Errorf("longitude %q is not a number between -180 and 180", lng)
+	}
+	return latitude, longitude, nil
+}
 
-// Vcap type to store VCAP_SERVICES
-type Vcap struct {
-	HodKey string
+// UpstreamError is havenondemand failing or answering with an error
+type UpstreamError struct {
+	Err error
 }
 
-var hodServiceInfo Service
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
 
-func setHodVcapServices() {
-	vcap := os.Getenv("VCAP_SERVICES")
-	if vcap == "" {
-		t := template.New("hello template")
-		t, _ = t.Parse(envVcapServices)
-		v := Vcap{HodKey: os.Getenv("HODKEY")}
-		var doc bytes.Buffer
-		t.Execute(&doc, v)
-		vcap = doc.String()
-	}
-	if err := json.Unmarshal([]byte(vcap), &hodServiceInfo); err != nil {
-		common.Logger.Error(err)
+// ErrorStatus is the status to answer an error of Lookup with: 502 when
+// havenondemand failed, 503 when it is not bound and 500 otherwise
+func ErrorStatus(err error) int {
+	if _, ok := err.(*UpstreamError); ok {
+		return http.StatusBadGateway
+	}
+	if common.IsUnavailable(err) {
+		return http.StatusServiceUnavailable
 	}
-	return
+	return http.StatusInternalServerError
 }
 
-// Info handler to get coordinate details from havenondemand
-func Info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	coord := Coordinate{
-		Latitude: ps.ByName("lat"),
-		Longitue: ps.ByName("lng"),
-	}
-	setHodVcapServices()
-	hodAPIKey := hodServiceInfo.HOD[0].Creds.APIKey
-	location := "&lat=" + coord.Latitude + "&lon=" + coord.Longitue + "&"
-	hodurl := "https://api.havenondemand.com/1/api/sync/mapcoordinates/v1?apikey=" + hodAPIKey + location + "targets=country&targets=timezone&targets=zipcode_us"
-	resp, err := http.Get(hodurl)
+// Lookup asks havenondemand for the country, time zone and zip code of a
+// coordinate, returning its json answer
+func Lookup(lat, lng float64) (body []byte, err error) {
+	defer common.ObserveCall("havenondemand", "Lookup", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return nil, err
+	}
+	key, err := apiKey()
 	if err != nil {
-		fmt.Fprintln(w, err)
-		return
+		return nil, err
+	}
+	query := url.Values{
+		"apikey":  {key},
+		"lat":     {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":     {strconv.FormatFloat(lng, 'f', -1, 64)},
+		"targets": {"country", "timezone", "zipcode_us"},
+	}
+	resp, err := client.Get(apiURL + "?" + query.Encode())
+	if err != nil {
+		// the error names the url, which holds the api key
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, &UpstreamError{err}
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintln(w, err)
+		return nil, &UpstreamError{err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{fmt.Errorf("havenondemand answered %s: %s", resp.Status, body)}
+	}
+	if !json.Valid(body) {
+		return nil, &UpstreamError{errors.New("havenondemand answered with invalid json")}
+	}
+	return body, nil
+}
+
+// Info handler to get coordinate details from havenondemand for the map
+// page. Errors are answered with a 5xx status so they are not cached.
+func Info(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	lat, lng, err := ParseCoordinate(ps.ByName("lat"), ps.ByName("lng"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var out bytes.Buffer
-	err = json.Indent(&out, body, "", "\t")
+	body, err := Lookup(lat, lng)
 	if err != nil {
-		fmt.Fprintln(w, err)
+		common.Logger.Error(err)
+		http.Error(w, err.Error(), ErrorStatus(err))
 		return
 	}
+	var out bytes.Buffer
+	json.Indent(&out, body, "", "\t")
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintln(w, out.String())
 }
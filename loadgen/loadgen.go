@@ -0,0 +1,311 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+)
+
+// Limits of a run, so one click cannot tie up a database for good
+var (
+	MaxUsers       = 100000
+	MaxConcurrency = 64
+	MaxDuration    = 5 * time.Minute
+)
+
+// Defaults for the options left at zero
+const (
+	DefaultUsers       = 1000
+	DefaultConcurrency = 8
+	DefaultDuration    = 30 * time.Second
+)
+
+// maxErrorSamples is how many distinct errors a report keeps
+const maxErrorSamples = 5
+
+// Operations run for every user, in order
+const (
+	Insert = "insert"
+	Read   = "read"
+	Update = "update"
+)
+
+var operations = []string{Insert, Read, Update}
+
+// Options of a run, it stops after Users users or Duration, whichever
+// comes first
+type Options struct {
+	Users       int           `json:"users"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"-"`
+	// Keep leaves the inserted users in the database, they are purged
+	// after the run otherwise
+	Keep bool `json:"keep"`
+}
+
+// Normalize fills in the defaults
+func (o *Options) Normalize() {
+	if o.Users <= 0 {
+		o.Users = DefaultUsers
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Duration <= 0 {
+		o.Duration = DefaultDuration
+	}
+}
+
+// Validate checks the normalized options against the limits
+func (o Options) Validate() error {
+	if o.Users > MaxUsers {
+		return fmt.Errorf("users must be at most %d", MaxUsers)
+	}
+	if o.Concurrency > MaxConcurrency {
+		return fmt.Errorf("concurrency must be at most %d", MaxConcurrency)
+	}
+	if o.Duration > MaxDuration {
+		return fmt.Errorf("duration must be at most %s", MaxDuration)
+	}
+	return nil
+}
+
+// Target is the database a run goes against
+type Target struct {
+	Name   string
+	Ready  func() error
+	Create func(models.User) (models.User, error)
+	Read   func(uint) (models.User, error)
+	Update func(uint, models.UserUpdate) (models.User, error)
+	Purge  func(uint) error
+}
+
+// OpStats sums up one operation of a run, latencies are of the successful
+// calls in milliseconds
+type OpStats struct {
+	Name      string  `json:"name"`
+	Ops       int     `json:"ops"`
+	Errors    int     `json:"errors"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	P50       float64 `json:"p50_ms"`
+	P95       float64 `json:"p95_ms"`
+	P99       float64 `json:"p99_ms"`
+}
+
+// Report of a run against one backend
+type Report struct {
+	Backend     string    `json:"backend"`
+	Options     Options   `json:"options"`
+	Duration    string    `json:"duration"`
+	Elapsed     float64   `json:"elapsed_seconds"`
+	Operations  []OpStats `json:"operations"`
+	Total       OpStats   `json:"total"`
+	Errors      []string  `json:"errors,omitempty"`
+	Purged      int       `json:"purged"`
+	PurgeErrors int       `json:"purge_errors,omitempty"`
+	// Error is set when the run could not start
+	Error string `json:"error,omitempty"`
+}
+
+// recorder collects the latencies and errors of one operation
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (r *recorder) record(start time.Time, err error) {
+	d := time.Since(start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+// percentile of sorted latencies by nearest rank, in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+func stats(name string, latencies []time.Duration, errors int, elapsed time.Duration) OpStats {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s := OpStats{
+		Name:   name,
+		Ops:    len(sorted),
+		Errors: errors,
+		P50:    percentile(sorted, .50),
+		P95:    percentile(sorted, .95),
+		P99:    percentile(sorted, .99),
+	}
+	if elapsed > 0 {
+		s.OpsPerSec = float64(s.Ops) / elapsed.Seconds()
+	}
+	return s
+}
+
+// errorSamples keeps the first few distinct errors of a run
+type errorSamples struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	list []string
+}
+
+func (e *errorSamples) add(op string, err error) {
+	message := op + ": " + err.Error()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.seen[message] || len(e.list) >= maxErrorSamples {
+		return
+	}
+	if e.seen == nil {
+		e.seen = map[string]bool{}
+	}
+	e.seen[message] = true
+	e.list = append(e.list, message)
+}
+
+// Run inserts, reads and updates users in the target with opts.Concurrency
+// workers and reports how it went
+func Run(target Target, opts Options) Report {
+	report := Report{Backend: target.Name, Options: opts, Duration: opts.Duration.String()}
+	if err := target.Ready(); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	// hash once, bcrypt would otherwise be most of every insert
+	password, err := models.HashPassword("loadgen")
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	recorders := map[string]*recorder{}
+	for _, op := range operations {
+		recorders[op] = &recorder{}
+	}
+	samples := &errorSamples{}
+	fail := func(op string, err error) {
+		samples.add(op, err)
+		common.Logger.Debugf("loadgen %s %s: %s", target.Name, op, err)
+	}
+
+	var (
+		next     int64
+		idsMu    sync.Mutex
+		ids      []uint
+		wg       sync.WaitGroup
+		run      = time.Now().UnixNano()
+		start    = time.Now()
+		deadline = start.Add(opts.Duration)
+	)
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&next, 1)
+				if n > int64(opts.Users) || time.Now().After(deadline) {
+					return
+				}
+				user := models.User{
+					Username: fmt.Sprintf("loadgen%d", n),
+					Email:    fmt.Sprintf("loadgen-%d-%d@example.com", run, n),
+					Password: password,
+				}
+				t := time.Now()
+				created, err := target.Create(user)
+				recorders[Insert].record(t, err)
+				if err != nil {
+					fail(Insert, err)
+					continue
+				}
+				idsMu.Lock()
+				ids = append(ids, created.ID)
+				idsMu.Unlock()
+
+				t = time.Now()
+				_, err = target.Read(created.ID)
+				recorders[Read].record(t, err)
+				if err != nil {
+					fail(Read, err)
+				}
+
+				username := user.Username + "u"
+				t = time.Now()
+				_, err = target.Update(created.ID, models.UserUpdate{Username: &username})
+				recorders[Update].record(t, err)
+				if err != nil {
+					fail(Update, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var all []time.Duration
+	errs := 0
+	for _, op := range operations {
+		r := recorders[op]
+		report.Operations = append(report.Operations, stats(op, r.latencies, r.errors, elapsed))
+		all = append(all, r.latencies...)
+		errs += r.errors
+	}
+	report.Total = stats("total", all, errs, elapsed)
+	report.Elapsed = elapsed.Seconds()
+	report.Errors = samples.list
+
+	if !opts.Keep {
+		report.Purged, report.PurgeErrors = purge(target, ids, opts.Concurrency)
+	}
+	return report
+}
+
+// purge deletes the users a run inserted, with the same concurrency
+func purge(target Target, ids []uint, concurrency int) (purged, failed int) {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		work = make(chan uint)
+	)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				err := target.Purge(id)
+				mu.Lock()
+				if err != nil {
+					common.Logger.Errorf("loadgen could not purge %s user %d: %s", target.Name, id, err)
+					failed++
+				} else {
+					purged++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, id := range ids {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+	return purged, failed
+}
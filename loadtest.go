@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cp16net/hod-test-app/loadgen"
+	"github.com/julienschmidt/httprouter"
+)
+
+// errLoadRunning is returned while another run has the databases busy
+var errLoadRunning = errors.New("a load run is already in progress")
+
+// maxLoadRuns is how many finished runs are kept to be looked at
+const maxLoadRuns = 10
+
+// LoadRun is a run of the load generator, it goes on in the background
+// and its reports are filled in once every backend is done
+type LoadRun struct {
+	ID       string           `json:"id"`
+	Instance string           `json:"instance"`
+	Backends []string         `json:"backends"`
+	Options  loadgen.Options  `json:"options"`
+	Duration string           `json:"duration"`
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Reports  []loadgen.Report `json:"reports,omitempty"`
+}
+
+// Done reports whether every backend finished
+func (r LoadRun) Done() bool {
+	return r.Finished != nil
+}
+
+// loadRuns are the runs of this instance, one goes at a time
+var loadRuns = struct {
+	sync.Mutex
+	running bool
+	byID    map[string]*LoadRun
+	// ids from the oldest run to the newest
+	ids []string
+}{byID: map[string]*LoadRun{}}
+
+// loadTarget points the load generator at a sql backend
+func loadTarget(name string) loadgen.Target {
+	backend := sqlBackends[name]
+	return loadgen.Target{
+		Name:   name,
+		Ready:  backend.Ready,
+		Create: backend.CreateUser,
+		Read:   backend.User,
+		Update: backend.UpdateUser,
+		Purge:  backend.PurgeUser,
+	}
+}
+
+// startLoad starts the load generator against the backends, every backend
+// when none are given, all at the same time. It returns the run right away,
+// look it up with loadRun to see how it is doing.
+func startLoad(backends []string, opts loadgen.Options) (LoadRun, error) {
+	opts.Normalize()
+	if err := opts.Validate(); err != nil {
+		return LoadRun{}, err
+	}
+	if len(backends) == 0 {
+		backends = sqlBackendNames
+	}
+	seen := map[string]bool{}
+	for _, name := range backends {
+		if _, ok := sqlBackends[name]; !ok {
+			return LoadRun{}, fmt.Errorf("unknown sql backend %q", name)
+		}
+		if seen[name] {
+			return LoadRun{}, fmt.Errorf("sql backend %q given twice", name)
+		}
+		seen[name] = true
+	}
+
+	loadRuns.Lock()
+	defer loadRuns.Unlock()
+	if loadRuns.running {
+		return LoadRun{}, errLoadRunning
+	}
+	started := time.Now().UTC()
+	run := &LoadRun{
+		ID:       strconv.FormatInt(started.UnixNano(), 36),
+		Instance: instanceIndex(),
+		Backends: backends,
+		Options:  opts,
+		Duration: opts.Duration.String(),
+		Started:  started,
+	}
+	loadRuns.running = true
+	loadRuns.byID[run.ID] = run
+	loadRuns.ids = append(loadRuns.ids, run.ID)
+	if len(loadRuns.ids) > maxLoadRuns {
+		delete(loadRuns.byID, loadRuns.ids[0])
+		loadRuns.ids = loadRuns.ids[1:]
+	}
+	go finishLoad(run)
+	return *run, nil
+}
+
+// finishLoad loads every backend of the run and stores the reports
+func finishLoad(run *LoadRun) {
+	reports := make([]loadgen.Report, len(run.Backends))
+	var wg sync.WaitGroup
+	for i, name := range run.Backends {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			reports[i] = loadgen.Run(loadTarget(name), run.Options)
+		}(i, name)
+	}
+	wg.Wait()
+	if run.Options.Keep {
+		invalidate(usersCache)
+	}
+
+	loadRuns.Lock()
+	defer loadRuns.Unlock()
+	finished := time.Now().UTC()
+	run.Reports, run.Finished = reports, &finished
+	loadRuns.running = false
+}
+
+// loadRun looks up a run of this instance
+func loadRun(id string) (LoadRun, bool) {
+	loadRuns.Lock()
+	defer loadRuns.Unlock()
+	run, ok := loadRuns.byID[id]
+	if !ok {
+		return LoadRun{}, false
+	}
+	return *run, true
+}
+
+// LoadData for the load page
+type LoadData struct {
+	Backends []string
+	Selected map[string]bool
+	Options  loadgen.Options
+	Run      *LoadRun
+	Error    string
+}
+
+func newLoadData() LoadData {
+	opts := loadgen.Options{}
+	opts.Normalize()
+	selected := map[string]bool{}
+	for _, name := range sqlBackendNames {
+		selected[name] = true
+	}
+	return LoadData{Backends: sqlBackendNames, Selected: selected, Options: opts}
+}
+
+// formInt reads an optional positive number from the form, zero when empty
+func formInt(r *http.Request, name string) (int, error) {
+	v := r.PostFormValue(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+// loadHandler shows the form to start a run, or the run of ?run=, which
+// reloads itself until the run is done
+func loadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := newLoadData()
+	id := r.URL.Query().Get("run")
+	if id == "" {
+		renderTemplate(w, "templates/load.html", data)
+		return
+	}
+	run, ok := loadRun(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		data.Error = fmt.Sprintf("load run %s not found on this instance", id)
+		renderTemplate(w, "templates/load.html", data)
+		return
+	}
+	data.Run, data.Options = &run, run.Options
+	data.Selected = map[string]bool{}
+	for _, name := range run.Backends {
+		data.Selected[name] = true
+	}
+	renderTemplate(w, "templates/load.html", data)
+}
+
+func loadRunHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := newLoadData()
+	data.Selected = map[string]bool{}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/load.html", data)
+		return
+	}
+	backends := r.PostForm["backend"]
+	for _, name := range backends {
+		data.Selected[name] = true
+	}
+	opts, err := loadOptions(r)
+	if err == nil {
+		data.Options = opts
+		data.Options.Normalize()
+		if len(backends) == 0 {
+			err = errors.New("pick at least one backend")
+		}
+	}
+	var run LoadRun
+	if err == nil {
+		run, err = startLoad(backends, opts)
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errLoadRunning {
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/load.html", data)
+		return
+	}
+	http.Redirect(w, r, "/sql/load?run="+url.QueryEscape(run.ID), http.StatusFound)
+}
+
+func loadOptions(r *http.Request) (opts loadgen.Options, err error) {
+	if opts.Users, err = formInt(r, "users"); err != nil {
+		return opts, err
+	}
+	if opts.Concurrency, err = formInt(r, "concurrency"); err != nil {
+		return opts, err
+	}
+	if d := r.PostFormValue("duration"); d != "" {
+		if opts.Duration, err = time.ParseDuration(d); err != nil {
+			return opts, fmt.Errorf("invalid duration: %s", err)
+		}
+	}
+	opts.Keep = r.PostFormValue("keep") != ""
+	return opts, nil
+}
+
+// APILoadRequest starts a load run, the zero values take the defaults
+type APILoadRequest struct {
+	Backends    []string `json:"backends"`
+	Users       int      `json:"users"`
+	Concurrency int      `json:"concurrency"`
+	Duration    string   `json:"duration"`
+	Keep        bool     `json:"keep"`
+}
+
+// apiLoadHandler starts a run and answers 202 with it right away, poll
+// /api/v1/load/:id for the reports. 409 while another run is in progress.
+func apiLoadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APILoadRequest{}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &body); err != nil {
+			renderAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	opts := loadgen.Options{Users: body.Users, Concurrency: body.Concurrency, Keep: body.Keep}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil {
+			renderAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid duration: %s", err))
+			return
+		}
+		opts.Duration = d
+	}
+	if opts.Users < 0 || opts.Concurrency < 0 || opts.Duration < 0 {
+		renderAPIError(w, http.StatusBadRequest, errors.New("users, concurrency and duration cannot be negative"))
+		return
+	}
+	run, err := startLoad(body.Backends, opts)
+	switch {
+	case err == errLoadRunning:
+		renderAPIError(w, http.StatusConflict, err)
+	case err != nil:
+		renderAPIError(w, http.StatusBadRequest, err)
+	default:
+		w.Header().Set("Location", "/api/v1/load/"+url.PathEscape(run.ID))
+		renderJSON(w, http.StatusAccepted, run)
+	}
+}
+
+// apiLoadRunHandler is how a run of this instance is doing
+func apiLoadRunHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	run, ok := loadRun(ps.ByName("id"))
+	if !ok {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("load run %s not found on this instance", ps.ByName("id")))
+		return
+	}
+	renderJSON(w, http.StatusOK, run)
+}
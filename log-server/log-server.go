@@ -1,13 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
 
-	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/streadway/amqp"
-	"gopkg.in/mgo.v2"
 
 	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mongo"
 )
 
 func failOnError(err error, msg string) {
@@ -16,38 +16,34 @@ func failOnError(err error, msg string) {
 	}
 }
 
-// Log struct for log data
-type Log struct {
-	Message string
-}
+var (
+	consumed = common.NewCounter("messages_consumed_total",
+		"Messages consumed from rabbitmq.", "exchange")
+	insertFailures = common.NewCounter("mongo_insert_failures_total",
+		"Log messages that could not be inserted into mongo.", "collection")
+)
 
 func main() {
-	appEnv, _ := cfenv.Current()
-	svcRabbitmq, err := appEnv.Services.WithName("cp16net-rabbitmq")
-	if err != nil {
-		panic("failed to get the cp16net-rabbitmq service details")
-	}
-	svcMongo, err := appEnv.Services.WithName("cp16net-mongo")
-	if err != nil {
-		panic("failed to get the cp16net-mongo service details")
-	}
-	mongouri, ok := svcMongo.CredentialString("uri")
-	if !ok {
-		common.Logger.Error("could not get the mongo connection uri string")
-	}
-
-	// TODO: this is a hack for the mongodb uri
-	// made PR to fix this in csm
-	mongouri = mongouri[:len(mongouri)-1]
-
-	mongodbname, ok := svcMongo.CredentialString("db")
-	if !ok {
-		panic("failed to get the credential name of db for mongo")
+	flag.StringVar(&common.ServicesFile, "services-file", common.ServicesFile,
+		"VCAP_SERVICES json or yaml file, or built-in profile (dev), used when VCAP_SERVICES is unset (env SERVICES_FILE)")
+	metricsAddr := flag.String("metrics-addr", common.DefaultMetricsAddr(":9091"),
+		"address to serve /metrics on (defaults to :$PORT when set)")
+	flag.Parse()
+	common.ServeMetrics(*metricsAddr)
+
+	services, err := common.LoadServices()
+	failOnError(err, "Failed to read the bound services")
+	svcRabbitmq, err := services.Find("cp16net-rabbitmq")
+	failOnError(err, "Failed to get the cp16net-rabbitmq service details")
+	// mongo resolves its own binding from the same services and logs why it
+	// is unavailable, inserts are retried once it comes up
+	if err := mongo.Ready(); err != nil {
+		common.Logger.Error("failed to connect to mongo: ", err)
 	}
 
-	rabbitmquri, ok := svcRabbitmq.CredentialString("uri")
-	if !ok {
-		panic("failed to get the credential uri for rabbitmq")
+	rabbitmquri := svcRabbitmq.URI()
+	if rabbitmquri == "" {
+		log.Fatal("failed to get the credential uri for rabbitmq")
 	}
 	conn, err := amqp.Dial(rabbitmquri)
 	failOnError(err, "Failed to connect to RabbitMQ")
@@ -97,17 +93,11 @@ func main() {
 	)
 	failOnError(err, "Failed to register a consumer")
 
-	mongoConn, err := mgo.Dial(mongouri)
-	if err != nil {
-		common.Logger.Error("failed to connect to mongo: ", err)
-	}
-	defer mongoConn.Close()
-	c := mongoConn.DB(mongodbname).C("gologger")
-
 	forever := make(chan bool)
 	go func() {
 		for d := range msgs {
-			insertData(c, d.Body)
+			consumed.Inc("logs")
+			insertData(d.Body)
 		}
 	}()
 
@@ -115,10 +105,10 @@ func main() {
 	<-forever
 }
 
-func insertData(c *mgo.Collection, data []byte) {
+func insertData(data []byte) {
 	// common.Logger.Infof(" [x] %s", data)
-	err := c.Insert(&Log{string(data)})
-	if err != nil {
-		common.Logger.Fatal(err)
+	if err := mongo.InsertLog(string(data)); err != nil {
+		insertFailures.Inc("gologger")
+		common.Logger.Error("failed to insert log into mongo: ", err)
 	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseCount(t *testing.T) {
+	for _, s := range []string{"", "x", "-1", "41", "1e3", "99999999999999999999"} {
+		if _, err := parseCount("n", s, 0, 40); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if n, err := parseCount("n", "40", 0, 40); err != nil || n != 40 {
+		t.Errorf("40: got %d, %v", n, err)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	for _, s := range []string{"x", "-1", "1.5", strconv.FormatInt(maxTTL+1, 10), "99999999999999999999"} {
+		if _, err := parseTTL(s, false); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if _, err := parseTTL("0", true); err == nil {
+		t.Error("a required ttl of 0: expected an error")
+	}
+	if ttl, err := parseTTL("", false); err != nil || ttl != 0 {
+		t.Errorf("no ttl: got %s, %v", ttl, err)
+	}
+	if ttl, err := parseTTL(strconv.FormatInt(maxTTL, 10), true); err != nil || ttl <= 0 {
+		t.Errorf("the longest ttl: got %s, %v", ttl, err)
+	}
+}
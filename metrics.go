@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpRequests = common.NewCounter("http_requests_total",
+		"HTTP requests served, by route and status code.", "method", "route", "code")
+	httpLatency = common.NewHistogram("http_request_duration_seconds",
+		"Latency of HTTP requests, by route.", nil, "method", "route")
+)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the wrapped writer so streaming handlers work
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument counts and times every request to the route pattern, and
+// gives it a request id
+func instrument(method, route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		setRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r, ps)
+		httpRequests.Inc(method, route, strconv.Itoa(rec.status))
+		httpLatency.ObserveSince(start, method, route)
+	}
+}
+
+// instrumentedRouter registers every route wrapped by instrument
+type instrumentedRouter struct {
+	*httprouter.Router
+}
+
+// Handle registers an instrumented handler for the method and path
+func (r instrumentedRouter) Handle(method, path string, h httprouter.Handle) {
+	r.Router.Handle(method, path, instrument(method, path, h))
+}
+
+// GET registers an instrumented handler for GET requests
+func (r instrumentedRouter) GET(path string, h httprouter.Handle) {
+	r.Handle("GET", path, h)
+}
+
+// POST registers an instrumented handler for POST requests
+func (r instrumentedRouter) POST(path string, h httprouter.Handle) {
+	r.Handle("POST", path, h)
+}
+
+// metricsHandler serves the prometheus metrics of the web application
+func metricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	common.MetricsHandler(w, r)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/migrations"
+	"github.com/cp16net/hod-test-app/store"
+)
+
+// MigrateCommand runs the sql migrations instead of the web server
+type MigrateCommand struct {
+	Backends []string `long:"backend" description:"Sql backend to migrate, may be repeated (default: every backend)"`
+	Steps    int      `long:"steps" default:"1" description:"How many migrations down reverts"`
+
+	Args struct {
+		Action string `positional-arg-name:"up|down|status"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// migrating reports whether the migrate command was given
+func migrating() bool {
+	return parser.Active != nil && parser.Active.Name == "migrate"
+}
+
+// runMigrate runs the migrate command on each backend and returns the exit
+// code
+func runMigrate(cmd MigrateCommand) int {
+	backends := cmd.Backends
+	if len(backends) == 0 {
+		backends = sqlBackendNames
+	}
+	switch cmd.Args.Action {
+	case "up", "down", "status":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate action %q, use up, down or status\n", cmd.Args.Action)
+		return 2
+	}
+	code := 0
+	for _, name := range backends {
+		backend, ok := sqlBackends[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown sql backend %q\n", name)
+			code = 1
+			continue
+		}
+		if err := migrateBackend(name, backend, cmd); err != nil {
+			common.Logger.Errorf("%s: %s", name, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+func migrateBackend(name string, backend store.UserStore, cmd MigrateCommand) error {
+	m, err := backend.Migrator()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var done []migrations.Migration
+	switch cmd.Args.Action {
+	case "up":
+		done, err = m.Up()
+	case "down":
+		done, err = m.Down(cmd.Steps)
+	case "status":
+		return printStatus(name, m)
+	}
+	for _, migration := range done {
+		fmt.Printf("%s: %s %d %s\n", name, cmd.Args.Action, migration.Version, migration.Name)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Printf("%s: nothing to migrate %s\n", name, cmd.Args.Action)
+	}
+	return err
+}
+
+func printStatus(name string, m *migrations.Migrator) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tVERSION\tNAME\tAPPLIED AT\n", name)
+	for _, s := range statuses {
+		at := "pending"
+		if s.Applied {
+			at = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(w, "\t%d\t%s\t%s\n", s.Version, s.Name, at)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,315 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+)
+
+// Dialects the migrations are written for
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// RunOnStart applies the pending migrations when a backend is first used,
+// when it is off the backend stays unavailable until migrate up is run
+var RunOnStart = true
+
+// LockTimeout is how long to wait for another instance that is migrating
+var LockTimeout = time.Minute
+
+// lockName identifies the migration lock in the database
+const lockName = "schema_migrations"
+
+// Migration is one numbered schema change, with the statements to apply
+// and revert it for each dialect
+type Migration struct {
+	Version int
+	Name    string
+	Up      map[string][]string
+	Down    map[string][]string
+	// Apply runs after the Up statements in the same transaction, for
+	// changes to the data that sql alone cannot make
+	Apply func(tx *sql.Tx, dialect string) error
+}
+
+// Status of one migration in a database
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// dialect has the sql that differs between databases
+type dialect struct {
+	createTable string
+	insert      string
+	remove      string
+	lock        func(ctx context.Context, conn *sql.Conn) error
+	unlock      func(conn *sql.Conn) error
+}
+
+var dialects = map[string]dialect{
+	MySQL: {
+		createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version int NOT NULL PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		insert: "INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+		remove: "DELETE FROM schema_migrations WHERE version = ?",
+		lock: func(ctx context.Context, conn *sql.Conn) error {
+			var got sql.NullInt64
+			err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(LockTimeout.Seconds())).Scan(&got)
+			if err != nil {
+				return err
+			}
+			if !got.Valid || got.Int64 != 1 {
+				return errLockTimeout
+			}
+			return nil
+		},
+		unlock: func(conn *sql.Conn) error {
+			_, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName)
+			return err
+		},
+	},
+	Postgres: {
+		createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer NOT NULL PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied_at timestamp with time zone NOT NULL DEFAULT now())`,
+		insert: "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		remove: "DELETE FROM schema_migrations WHERE version = $1",
+		lock: func(ctx context.Context, conn *sql.Conn) error {
+			// pg_advisory_lock cannot time out, so poll the try variant
+			for {
+				var got bool
+				if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lockName).Scan(&got); err != nil {
+					return err
+				}
+				if got {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return errLockTimeout
+				case <-time.After(500 * time.Millisecond):
+				}
+			}
+		},
+		unlock: func(conn *sql.Conn) error {
+			_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockName)
+			return err
+		},
+	},
+	SQLite: {
+		createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer NOT NULL PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		insert: "INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+		remove: "DELETE FROM schema_migrations WHERE version = ?",
+		// sqlite has no named locks, the database is a local file and its
+		// write lock keeps two migrations from interleaving
+		lock:   func(ctx context.Context, conn *sql.Conn) error { return nil },
+		unlock: func(conn *sql.Conn) error { return nil },
+	},
+}
+
+var errLockTimeout = errors.New("timed out waiting for another instance to finish migrating")
+
+// Migrator applies and reverts the migrations of one database
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+// New creates a migrator for a database of the dialect
+func New(db *sql.DB, dialectName string) (*Migrator, error) {
+	if _, ok := dialects[dialectName]; !ok {
+		return nil, fmt.Errorf("no migrations for the %s dialect", dialectName)
+	}
+	ms := append([]Migration(nil), all...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return &Migrator{db: db, dialect: dialectName, migrations: ms}, nil
+}
+
+// Close closes the database of the migrator
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// locked runs fn on a single connection that holds the migration lock, so
+// only one instance migrates at a time
+func (m *Migrator) locked(fn func(conn *sql.Conn) error) error {
+	d := dialects[m.dialect]
+	ctx, cancel := context.WithTimeout(context.Background(), LockTimeout)
+	defer cancel()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := d.lock(ctx, conn); err != nil {
+		return fmt.Errorf("could not take the migration lock: %s", err)
+	}
+	defer func() {
+		if err := d.unlock(conn); err != nil {
+			common.Logger.Error("could not release the migration lock: ", err)
+		}
+	}()
+	if _, err := conn.ExecContext(context.Background(), d.createTable); err != nil {
+		return fmt.Errorf("could not create the migrations table: %s", err)
+	}
+	return fn(conn)
+}
+
+// applied returns when each applied migration was applied
+func applied(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version] = at
+	}
+	return versions, rows.Err()
+}
+
+// run executes the statements of a migration and records it, in one
+// transaction where the database allows ddl in transactions
+func (m *Migrator) run(conn *sql.Conn, migration Migration, up bool) error {
+	d := dialects[m.dialect]
+	statements, record, args := migration.Down[m.dialect], d.remove, []interface{}{migration.Version}
+	if up {
+		statements, record, args = migration.Up[m.dialect], d.insert, []interface{}{migration.Version, migration.Name}
+	}
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err)
+		}
+	}
+	if up && migration.Apply != nil {
+		if err := migration.Apply(tx, m.dialect); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d %s: %s", migration.Version, migration.Name, err)
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Up applies every pending migration in order
+func (m *Migrator) Up() (done []Migration, err error) {
+	err = m.locked(func(conn *sql.Conn) error {
+		versions, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			common.Logger.Infof("%s: applying migration %d %s", m.dialect, migration.Version, migration.Name)
+			if err := m.run(conn, migration, true); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first
+func (m *Migrator) Down(steps int) (done []Migration, err error) {
+	err = m.locked(func(conn *sql.Conn) error {
+		versions, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			common.Logger.Infof("%s: reverting migration %d %s", m.dialect, migration.Version, migration.Name)
+			if err := m.run(conn, migration, false); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every migration and whether it is applied
+func (m *Migrator) Status() (statuses []Status, err error) {
+	err = m.locked(func(conn *sql.Conn) error {
+		versions, err := applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			s := Status{Version: migration.Version, Name: migration.Name}
+			if at, ok := versions[migration.Version]; ok {
+				s.Applied, s.AppliedAt = true, &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Prepare brings a database up to date when a backend starts, or when
+// RunOnStart is off reports the migrations that still have to be run
+func Prepare(db *sql.DB, dialectName string) error {
+	m, err := New(db, dialectName)
+	if err != nil {
+		return err
+	}
+	if RunOnStart {
+		_, err := m.Up()
+		return err
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range statuses {
+		if !s.Applied {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d migrations are pending, run migrate up", pending)
+	}
+	return nil
+}
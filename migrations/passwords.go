@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+)
+
+// hashPlaintextPasswords replaces the passwords stored before they were
+// hashed with their bcrypt hash. Empty passwords are left alone, no
+// password matches them so nobody can log in as those users.
+func hashPlaintextPasswords(tx *sql.Tx, dialect string) error {
+	rows, err := tx.Query("SELECT id, password FROM users WHERE password IS NOT NULL AND password <> ''")
+	if err != nil {
+		return err
+	}
+	plain := map[uint]string{}
+	for rows.Next() {
+		var id uint
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return err
+		}
+		if !models.IsHashed(password) {
+			plain[id] = password
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	update := "UPDATE users SET password = ? WHERE id = ?"
+	if dialect == Postgres {
+		update = "UPDATE users SET password = $1 WHERE id = $2"
+	}
+	for id, password := range plain {
+		hash, err := models.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(update, hash, id); err != nil {
+			return err
+		}
+	}
+	if len(plain) > 0 {
+		common.Logger.Infof("%s: hashed %d plaintext passwords", dialect, len(plain))
+	}
+	return nil
+}
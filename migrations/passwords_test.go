@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"golang.org/x/crypto/bcrypt"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // the sqlite3 driver
+)
+
+func TestHashPlaintextPasswords(t *testing.T) {
+	models.PasswordCost = bcrypt.MinCost
+	db, err := sql.Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// the users of a database from before the passwords were hashed
+	for _, statement := range all[0].Up[SQLite] {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, _ := models.HashPassword("hashed")
+	for _, password := range []string{"plain", "", hash} {
+		if _, err := db.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)", "u", password+"@test", password); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := New(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	stored := map[string]string{}
+	rows, err := db.Query("SELECT email, password FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var email, password string
+		rows.Scan(&email, &password)
+		stored[email] = password
+	}
+	rows.Close()
+
+	if user := (models.User{Password: stored["plain@test"]}); !user.CheckPassword("plain") {
+		t.Errorf("the plaintext password was not hashed: %q", stored["plain@test"])
+	}
+	if stored["@test"] != "" {
+		t.Errorf("an empty password was hashed: %q", stored["@test"])
+	}
+	if stored[hash+"@test"] != hash {
+		t.Error("a hashed password was hashed again")
+	}
+}
@@ -0,0 +1,183 @@
+package migrations
+
+// all is every migration, numbered in the order they are applied. Never
+// change one that has shipped, add a new one instead.
+var all = []Migration{
+	{
+		// the table gorm AutoMigrate used to create, so existing databases
+		// pick it up as already applied
+		Version: 1,
+		Name:    "create users",
+		Up: map[string][]string{
+			MySQL: {
+				`CREATE TABLE IF NOT EXISTS users (
+					id int unsigned NOT NULL AUTO_INCREMENT,
+					created_at timestamp NULL,
+					updated_at timestamp NULL,
+					deleted_at timestamp NULL,
+					username varchar(255),
+					email varchar(100),
+					password varchar(255),
+					PRIMARY KEY (id),
+					INDEX idx_users_deleted_at (deleted_at),
+					UNIQUE INDEX uix_users_email (email))`,
+			},
+			Postgres: {
+				`CREATE TABLE IF NOT EXISTS users (
+					id serial PRIMARY KEY,
+					created_at timestamp with time zone,
+					updated_at timestamp with time zone,
+					deleted_at timestamp with time zone,
+					username varchar(255),
+					email varchar(100),
+					password text)`,
+				"CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email)",
+			},
+			SQLite: {
+				`CREATE TABLE IF NOT EXISTS users (
+					id integer PRIMARY KEY AUTOINCREMENT,
+					created_at datetime,
+					updated_at datetime,
+					deleted_at datetime,
+					username varchar(255),
+					email varchar(100),
+					password varchar(255))`,
+				"CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email)",
+			},
+		},
+		Down: map[string][]string{
+			MySQL:    {"DROP TABLE users"},
+			Postgres: {"DROP TABLE users"},
+			SQLite:   {"DROP TABLE users"},
+		},
+	},
+	{
+		// users written to one database and waiting to be copied to the
+		// others
+		Version: 2,
+		Name:    "create outbox",
+		Up: map[string][]string{
+			MySQL: {
+				`CREATE TABLE outbox (
+					id bigint unsigned NOT NULL AUTO_INCREMENT,
+					target varchar(32) NOT NULL,
+					payload text NOT NULL,
+					attempts int NOT NULL DEFAULT 0,
+					last_error varchar(1024) NOT NULL DEFAULT '',
+					next_attempt_at timestamp NULL,
+					delivered_at timestamp NULL,
+					created_at timestamp NULL,
+					PRIMARY KEY (id),
+					INDEX idx_outbox_due (delivered_at, next_attempt_at))`,
+			},
+			Postgres: {
+				`CREATE TABLE outbox (
+					id bigserial PRIMARY KEY,
+					target varchar(32) NOT NULL,
+					payload text NOT NULL,
+					attempts integer NOT NULL DEFAULT 0,
+					last_error varchar(1024) NOT NULL DEFAULT '',
+					next_attempt_at timestamp with time zone,
+					delivered_at timestamp with time zone,
+					created_at timestamp with time zone)`,
+				"CREATE INDEX idx_outbox_due ON outbox (delivered_at, next_attempt_at)",
+			},
+			SQLite: {
+				`CREATE TABLE outbox (
+					id integer PRIMARY KEY AUTOINCREMENT,
+					target varchar(32) NOT NULL,
+					payload text NOT NULL,
+					attempts integer NOT NULL DEFAULT 0,
+					last_error varchar(1024) NOT NULL DEFAULT '',
+					next_attempt_at datetime,
+					delivered_at datetime,
+					created_at datetime)`,
+				"CREATE INDEX idx_outbox_due ON outbox (delivered_at, next_attempt_at)",
+			},
+		},
+		Down: map[string][]string{
+			MySQL:    {"DROP TABLE outbox"},
+			Postgres: {"DROP TABLE outbox"},
+			SQLite:   {"DROP TABLE outbox"},
+		},
+	},
+	{
+		// who did what through the app, see the audit package
+		Version: 3,
+		Name:    "create audit log",
+		Up: map[string][]string{
+			MySQL: {
+				`CREATE TABLE audit_log (
+					id bigint unsigned NOT NULL AUTO_INCREMENT,
+					created_at timestamp NULL,
+					request_id varchar(64) NOT NULL DEFAULT '',
+					instance varchar(16) NOT NULL DEFAULT '',
+					client_ip varchar(64) NOT NULL DEFAULT '',
+					backend varchar(32) NOT NULL DEFAULT '',
+					user_id int unsigned NOT NULL DEFAULT 0,
+					username varchar(255) NOT NULL DEFAULT '',
+					action varchar(64) NOT NULL,
+					method varchar(8) NOT NULL,
+					path varchar(1024) NOT NULL,
+					status int NOT NULL,
+					outcome varchar(16) NOT NULL,
+					PRIMARY KEY (id),
+					INDEX idx_audit_log_created_at (created_at),
+					INDEX idx_audit_log_username (username),
+					INDEX idx_audit_log_action (action))`,
+			},
+			Postgres: {
+				`CREATE TABLE audit_log (
+					id bigserial PRIMARY KEY,
+					created_at timestamp with time zone,
+					request_id varchar(64) NOT NULL DEFAULT '',
+					instance varchar(16) NOT NULL DEFAULT '',
+					client_ip varchar(64) NOT NULL DEFAULT '',
+					backend varchar(32) NOT NULL DEFAULT '',
+					user_id integer NOT NULL DEFAULT 0,
+					username varchar(255) NOT NULL DEFAULT '',
+					action varchar(64) NOT NULL,
+					method varchar(8) NOT NULL,
+					path varchar(1024) NOT NULL,
+					status integer NOT NULL,
+					outcome varchar(16) NOT NULL)`,
+				"CREATE INDEX idx_audit_log_created_at ON audit_log (created_at)",
+				"CREATE INDEX idx_audit_log_username ON audit_log (username)",
+				"CREATE INDEX idx_audit_log_action ON audit_log (action)",
+			},
+			SQLite: {
+				`CREATE TABLE audit_log (
+					id integer PRIMARY KEY AUTOINCREMENT,
+					created_at datetime,
+					request_id varchar(64) NOT NULL DEFAULT '',
+					instance varchar(16) NOT NULL DEFAULT '',
+					client_ip varchar(64) NOT NULL DEFAULT '',
+					backend varchar(32) NOT NULL DEFAULT '',
+					user_id integer NOT NULL DEFAULT 0,
+					username varchar(255) NOT NULL DEFAULT '',
+					action varchar(64) NOT NULL,
+					method varchar(8) NOT NULL,
+					path varchar(1024) NOT NULL,
+					status integer NOT NULL,
+					outcome varchar(16) NOT NULL)`,
+				"CREATE INDEX idx_audit_log_created_at ON audit_log (created_at)",
+				"CREATE INDEX idx_audit_log_username ON audit_log (username)",
+				"CREATE INDEX idx_audit_log_action ON audit_log (action)",
+			},
+		},
+		Down: map[string][]string{
+			MySQL:    {"DROP TABLE audit_log"},
+			Postgres: {"DROP TABLE audit_log"},
+			SQLite:   {"DROP TABLE audit_log"},
+		},
+	},
+	{
+		// passwords were stored in plain text before they were hashed, a
+		// hash cannot be turned back so there is nothing to revert
+		Version: 4,
+		Name:    "hash plaintext passwords",
+		Apply:   hashPlaintextPasswords,
+	},
+}
@@ -1,7 +1,9 @@
 package mongo
 
 import (
-	"github.com/cloudfoundry-community/go-cfenv"
+	"fmt"
+	"time"
+
 	"github.com/cp16net/hod-test-app/common"
 	"github.com/cp16net/hod-test-app/rabbitmq"
 	"gopkg.in/mgo.v2"
@@ -13,34 +15,66 @@ type LogData struct {
 	Count int
 }
 
-// GetLogs returns the list of logs in the db
-func GetLogs() LogData {
-	appEnv, _ := cfenv.Current()
-	mongosvc, err := appEnv.Services.WithName("cp16net-mongo")
+// serviceName of the bound mongo service
+const serviceName = "cp16net-mongo"
+
+var dbname string
+
+// logCollection holds the messages stored by the log-server
+const logCollection = "gologger"
+
+// session is the pooled master session, requests work on a Copy of it
+var session *mgo.Session
+
+// setup resolves the mongo binding and dials the first time it is used
+var setup = common.NewLazy("mongo", func() error {
+	mongosvc, err := common.FindService(serviceName)
+	if err != nil {
+		return err
+	}
+	uri := mongosvc.URI()
+	if uri == "" {
+		return fmt.Errorf("failed to get the credential uri for %s", serviceName)
+	}
+	db, _ := mongosvc.Credential("db")
+	info, err := ParseURI(uri, db)
 	if err != nil {
-		panic("failed to get the cp16net-mongo service details")
+		return err
 	}
-	uri, ok := mongosvc.CredentialString("uri")
-	if !ok {
-		panic("failed to get the credential uri for mongo")
+	s, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return fmt.Errorf("failed to connect to mongo: %s", err)
 	}
+	s.SetPoolLimit(common.PoolSize)
+	session, dbname = s, info.Database
+	return nil
+})
 
-	// TODO: this is a hack for the mongodb uri
-	// made PR to fix this in csm
-	uri = uri[:len(uri)-1]
+// Ready initializes mongo if needed and returns why it is unavailable
+func Ready() error {
+	return setup.Ready()
+}
 
-	dbname, ok := mongosvc.CredentialString("db")
-	if !ok {
-		panic("failed to get the credential name of db for mongo")
+// Ping checks that mongo answers on a copy of the shared session
+func Ping() error {
+	if err := Ready(); err != nil {
+		return err
 	}
-	session, err := mgo.Dial(uri)
-	if err != nil {
-		common.Logger.Error("failed to connect to mongo: ", err)
+	s := session.Copy()
+	defer s.Close()
+	return s.Ping()
+}
+
+// GetLogs returns the list of logs in the db
+func GetLogs() (result LogData, err error) {
+	defer common.ObserveCall("mongo", "GetLogs", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return result, err
 	}
-	defer session.Close()
-	// session.SetMode(mgo.Monotonic, true)
-	result := LogData{}
-	c := session.DB(dbname).C("gologger")
+	s := session.Copy()
+	defer s.Close()
+	// s.SetMode(mgo.Monotonic, true)
+	c := s.DB(dbname).C(logCollection)
 	query := c.Find(nil)
 	size, err := query.Count()
 	if err != nil {
@@ -49,8 +83,16 @@ func GetLogs() LogData {
 	result.Count = size
 	iter := query.Sort("-$natural").Limit(100).Iter()
 	err = iter.All(&result.Logs)
-	if err != nil {
-		common.Logger.Fatal(err)
+	return result, err
+}
+
+// InsertLog stores a log message, it is used by the log-server
+func InsertLog(message string) (err error) {
+	defer common.ObserveCall("mongo", "InsertLog", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
 	}
-	return result
+	s := session.Copy()
+	defer s.Close()
+	return s.DB(dbname).C(logCollection).Insert(&rabbitmq.Log{Message: message})
 }
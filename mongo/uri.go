@@ -0,0 +1,126 @@
+package mongo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// DefaultTimeout is used when the uri has no connectTimeoutMS option
+var DefaultTimeout = 10 * time.Second
+
+// ParseURI validates a mongodb:// uri and turns it into dial settings. The
+// tls options mgo does not know about (ssl, tls, tlsCAFile,
+// tlsAllowInvalidCertificates) and connectTimeoutMS are handled here, the
+// rest are left to mgo. db is the database to use, when it is empty the
+// database is taken from the uri path. The uri path is kept as the
+// authentication database unless authSource says otherwise.
+func ParseURI(uri, db string) (*mgo.DialInfo, error) {
+	uri = strings.TrimSpace(uri)
+	if !strings.HasPrefix(uri, "mongodb://") {
+		return nil, errors.New("mongo uri must start with mongodb://")
+	}
+	base, query := uri, ""
+	if i := strings.Index(uri, "?"); i != -1 {
+		base, query = uri[:i], uri[i+1:]
+	}
+
+	var tlsConfig *tls.Config
+	timeout := DefaultTimeout
+	var passthrough []string
+	for _, pair := range strings.FieldsFunc(query, func(r rune) bool { return r == '&' || r == ';' }) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("mongo uri option must be key=value: %s", pair)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "ssl", "tls":
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for %s: %s", key, value)
+			}
+			if on && tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+		case "tlsAllowInvalidCertificates", "sslAllowInvalidCertificates", "tlsInsecure":
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for %s: %s", key, value)
+			}
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.InsecureSkipVerify = insecure
+		case "tlsCAFile", "sslCAFile":
+			pem, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %s", key, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", value)
+			}
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.RootCAs = pool
+		case "connectTimeoutMS":
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("bad value for connectTimeoutMS: %s", value)
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		default:
+			passthrough = append(passthrough, pair)
+		}
+	}
+	if len(passthrough) > 0 {
+		base += "?" + strings.Join(passthrough, "&")
+	}
+
+	info, err := mgo.ParseURL(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mongo uri: %s", err)
+	}
+	for _, addr := range info.Addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// mgo defaults the port when there is none
+			host, port = addr, "27017"
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid mongo uri: empty host in %q", addr)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid mongo uri: bad port in %q", addr)
+		}
+	}
+
+	info.Database = strings.Trim(info.Database, "/")
+	if info.Source == "" && info.Database != "" {
+		info.Source = info.Database
+	}
+	if db != "" {
+		info.Database = db
+	}
+	if info.Database == "" {
+		return nil, errors.New("mongo uri has no database and no db was given")
+	}
+
+	info.Timeout = timeout
+	if tlsConfig != nil {
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), tlsConfig)
+		}
+	}
+	return info, nil
+}
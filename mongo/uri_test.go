@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func parse(t *testing.T, uri, db string) *mgo.DialInfo {
+	info, err := ParseURI(uri, db)
+	if err != nil {
+		t.Fatalf("%q: %s", uri, err)
+	}
+	return info
+}
+
+func TestParseURI(t *testing.T) {
+	info := parse(t, "mongodb://u:p@h1:27017,h2/app", "")
+	if len(info.Addrs) != 2 || info.Addrs[0] != "h1:27017" || info.Addrs[1] != "h2" {
+		t.Errorf("addrs %v", info.Addrs)
+	}
+	if info.Database != "app" || info.Source != "app" {
+		t.Errorf("database %q source %q, want the database of the path", info.Database, info.Source)
+	}
+	if info.Username != "u" || info.Password != "p" {
+		t.Errorf("user %q password %q", info.Username, info.Password)
+	}
+	if info.Timeout != DefaultTimeout || info.DialServer != nil {
+		t.Errorf("timeout %s, tls %v", info.Timeout, info.DialServer != nil)
+	}
+
+	// a database given by the caller wins, the path still names the auth
+	// database
+	info = parse(t, "mongodb://u:p@h/admin", "logs")
+	if info.Database != "logs" || info.Source != "admin" {
+		t.Errorf("database %q source %q", info.Database, info.Source)
+	}
+
+	info = parse(t, "mongodb://u:p@h/app?authSource=admin&connectTimeoutMS=1500", "")
+	if info.Source != "admin" || info.Timeout != 1500*time.Millisecond {
+		t.Errorf("source %q timeout %s", info.Source, info.Timeout)
+	}
+
+	info = parse(t, " mongodb://h/app?ssl=true;tlsAllowInvalidCertificates=true ", "")
+	if info.DialServer == nil {
+		t.Error("ssl=true did not enable tls")
+	}
+}
+
+func TestParseURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"postgres://h/app",
+		"mongodb://h",
+		"mongodb://h:99999/app",
+		"mongodb://:27017/app",
+		"mongodb://h/app?ssl=maybe",
+		"mongodb://h/app?connectTimeoutMS=0",
+		"mongodb://h/app?tlsCAFile=/does/not/exist",
+		"mongodb://h/app?ssl",
+	} {
+		if _, err := ParseURI(uri, ""); err == nil {
+			t.Errorf("%q: expected an error", uri)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	"github.com/cp16net/hod-test-app/common"
+)
+
+func generateString(length int, characters string) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(characters)))
+	for i := range b {
+		var c byte
+		rint, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			common.Logger.Error(err)
+			return "", errors.New("Unable to generate a string. Error : " + err.Error())
+		}
+		c = characters[rint.Int64()]
+		b[i] = c
+	}
+	return string(b), nil
+}
+
+const usercharacters = "abcdefghijklmnopqrstuvwxyz"
+const passwordcharacters = `abcdefghijklmnopqrstuvwxyz1234567890`
+
+// RandomUser makes up a user with a random name and password, the
+// plaintext password is kept in GeneratedPassword
+func RandomUser() (User, error) {
+	username, err := generateString(10, usercharacters)
+	if err != nil {
+		return User{}, err
+	}
+	password, err := generateString(10, passwordcharacters)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := NewUser(username, username+"@gmail.com", password)
+	if err != nil {
+		return user, err
+	}
+	user.GeneratedPassword = password
+	return user, nil
+}
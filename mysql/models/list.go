@@ -0,0 +1,261 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrUserNotFound is returned when no user has the id
+var ErrUserNotFound = errors.New("user not found")
+
+// DefaultPerPage is the page size used when none is asked for
+const DefaultPerPage = 20
+
+// MaxPerPage is the largest page that is handed out
+const MaxPerPage = 100
+
+// maxSearchLength caps the username and email filters
+const maxSearchLength = 100
+
+// dateLayout is the short form a created at filter can be given in
+const dateLayout = "2006-01-02"
+
+// sortColumns are the columns a listing can be sorted by
+var sortColumns = map[string]bool{
+	"id":         true,
+	"username":   true,
+	"email":      true,
+	"created_at": true,
+	"updated_at": true,
+	"deleted_at": true,
+}
+
+// ListOptions selects one page of users
+type ListOptions struct {
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+	Sort    string `json:"sort"`
+	Desc    bool   `json:"desc"`
+	// Deleted lists the soft deleted users instead of the live ones
+	Deleted bool `json:"deleted"`
+	// IncludeDeleted lists the live and the soft deleted users together
+	IncludeDeleted bool `json:"include_deleted"`
+	// Username and Email keep the users whose column contains them,
+	// ignoring case
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	// CreatedAfter and CreatedBefore bound created_at, the first one
+	// inclusive and the second one exclusive
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+}
+
+// Normalize fills in the defaults and clamps the page size
+func (o ListOptions) Normalize() ListOptions {
+	if o.Page < 1 {
+		o.Page = 1
+	}
+	if o.PerPage < 1 {
+		o.PerPage = DefaultPerPage
+	}
+	if o.PerPage > MaxPerPage {
+		o.PerPage = MaxPerPage
+	}
+	if o.Sort == "" {
+		o.Sort = "id"
+	}
+	return o
+}
+
+// Validate checks the sort column, which ends up in the sql, and that the
+// filters can match anything
+func (o ListOptions) Validate() error {
+	if !sortColumns[o.Sort] {
+		return fmt.Errorf("cannot sort by %q", o.Sort)
+	}
+	if o.Deleted && o.IncludeDeleted {
+		return errors.New("cannot list only the deleted users and include the live ones")
+	}
+	if len(o.Username) > maxSearchLength || len(o.Email) > maxSearchLength {
+		return fmt.Errorf("username and email filters are at most %d characters", maxSearchLength)
+	}
+	if o.CreatedAfter != nil && o.CreatedBefore != nil && !o.CreatedAfter.Before(*o.CreatedBefore) {
+		return errors.New("created_after must be before created_before")
+	}
+	return nil
+}
+
+// ShowDeleted reports whether the listing can hold soft deleted users
+func (o ListOptions) ShowDeleted() bool {
+	return o.Deleted || o.IncludeDeleted
+}
+
+// Filtered reports whether any filter is set
+func (o ListOptions) Filtered() bool {
+	return o.Username != "" || o.Email != "" || o.CreatedAfter != nil || o.CreatedBefore != nil
+}
+
+// likeEscaper escapes the LIKE wildcards with !, which unlike a backslash
+// means the same in every sql dialect
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// contains is a LIKE pattern matching s anywhere, lower cased so the
+// match ignores case in every dialect
+func contains(s string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(s)) + "%"
+}
+
+// Where is the condition of the username, email and created at filters
+// with its arguments, empty when none is set. The deleted state is left to
+// the caller, which decides whether the query is scoped.
+func (o ListOptions) Where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if o.Username != "" {
+		conds = append(conds, "LOWER(username) LIKE ? ESCAPE '!'")
+		args = append(args, contains(o.Username))
+	}
+	if o.Email != "" {
+		conds = append(conds, "LOWER(email) LIKE ? ESCAPE '!'")
+		args = append(args, contains(o.Email))
+	}
+	if o.CreatedAfter != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, *o.CreatedAfter)
+	}
+	if o.CreatedBefore != nil {
+		conds = append(conds, "created_at < ?")
+		args = append(args, *o.CreatedBefore)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// ParseTimeFilter reads a created at filter, a RFC 3339 time or a date
+// which stands for its midnight in UTC
+func ParseTimeFilter(s string) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a date (%s) nor a RFC 3339 time", s, dateLayout)
+	}
+	return &t, nil
+}
+
+// FormatTimeFilter is the inverse of ParseTimeFilter, giving midnights in
+// UTC as a date
+func FormatTimeFilter(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	if t.Location() == time.UTC && t.Equal(t.Truncate(24*time.Hour)) {
+		return t.Format(dateLayout)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Offset of the first row of the page
+func (o ListOptions) Offset() int {
+	return (o.Page - 1) * o.PerPage
+}
+
+// OrderBy is the order clause for the options
+func (o ListOptions) OrderBy() string {
+	if o.Desc {
+		return o.Sort + " desc"
+	}
+	return o.Sort + " asc"
+}
+
+// UserPage is one page of a user listing
+type UserPage struct {
+	ListOptions
+	Total int    `json:"total"`
+	Pages int    `json:"pages"`
+	Users []User `json:"users"`
+}
+
+// NewUserPage works out the page count for the rows found
+func NewUserPage(opts ListOptions, total int, users []User) UserPage {
+	pages := (total + opts.PerPage - 1) / opts.PerPage
+	return UserPage{ListOptions: opts, Total: total, Pages: pages, Users: users}
+}
+
+// HasPrev reports whether there is a page before this one
+func (p UserPage) HasPrev() bool {
+	return p.Page > 1
+}
+
+// HasNext reports whether there is a page after this one
+func (p UserPage) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+// UserUpdate holds the fields of a user to change, nil fields are kept
+type UserUpdate struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+}
+
+// Validate rejects empty values and malformed emails
+func (u UserUpdate) Validate() error {
+	if u.Username == nil && u.Email == nil && u.Password == nil {
+		return errors.New("nothing to update")
+	}
+	if u.Username != nil && strings.TrimSpace(*u.Username) == "" {
+		return errors.New("username cannot be empty")
+	}
+	if u.Email != nil && !strings.Contains(*u.Email, "@") {
+		return fmt.Errorf("%q is not an email address", *u.Email)
+	}
+	if u.Password != nil && *u.Password == "" {
+		return errors.New("password cannot be empty")
+	}
+	return nil
+}
+
+// Fields are the columns to update, with the password hashed
+func (u UserUpdate) Fields() (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if u.Username != nil {
+		fields["username"] = strings.TrimSpace(*u.Username)
+	}
+	if u.Email != nil {
+		fields["email"] = strings.TrimSpace(*u.Email)
+	}
+	if u.Password != nil {
+		hash, err := HashPassword(*u.Password)
+		if err != nil {
+			return nil, err
+		}
+		fields["password"] = hash
+	}
+	return fields, nil
+}
+
+// Upsert says what an imported user may change of an existing user with
+// the same email, besides the username and timestamps
+type Upsert struct {
+	// Password replaces the stored password, when the import has one
+	Password bool
+	// DeletedAt replaces when the user was deleted, a nil DeletedAt
+	// restores them
+	DeletedAt bool
+}
+
+// NewUser validates the fields of a user signing up and hashes the password
+func NewUser(username, email, password string) (User, error) {
+	update := UserUpdate{Username: &username, Email: &email, Password: &password}
+	if err := update.Validate(); err != nil {
+		return User{}, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	return User{Username: strings.TrimSpace(username), Email: strings.TrimSpace(email), Password: hash}, nil
+}
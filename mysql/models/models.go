@@ -7,5 +7,9 @@ type User struct {
 	gorm.Model
 	Username string `gorm:"size:255"`
 	Email    string `gorm:"type:varchar(100);unique_index"`
-	Password string
+	// Password is the bcrypt hash, it is never sent to clients
+	Password string `json:"-"`
+	// GeneratedPassword is the plaintext of a generated password, only set
+	// on the user returned by RandomUser so it can be shown once
+	GeneratedPassword string `gorm:"-" json:"generated_password,omitempty"`
 }
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidLogin is returned for an unknown user or a wrong password, the
+// two are not told apart
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+// PasswordCost is the bcrypt cost passwords are hashed with
+var PasswordCost = bcrypt.DefaultCost
+
+// HashPassword returns the bcrypt hash stored for a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHashed reports whether a stored password is already a bcrypt hash,
+// rows written before passwords were hashed hold the plaintext
+func IsHashed(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// CheckPassword reports whether password matches the stored hash
+func (u User) CheckPassword(password string) bool {
+	if !IsHashed(u.Password) {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
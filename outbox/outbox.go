@@ -0,0 +1,145 @@
+package outbox
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/jinzhu/gorm"
+)
+
+// MaxBackoff caps the wait between two delivery attempts of an entry
+var MaxBackoff = 5 * time.Minute
+
+// Entry is a user waiting to be written to another database
+type Entry struct {
+	ID            uint64     `json:"id" gorm:"primary_key"`
+	Target        string     `json:"target"`
+	Payload       string     `json:"-"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// TableName of the outbox, created by the migrations
+func (Entry) TableName() string {
+	return "outbox"
+}
+
+// User decodes the user carried by the entry
+func (e Entry) User() (models.User, error) {
+	user := models.User{}
+	err := json.Unmarshal([]byte(e.Payload), &userPayload{&user})
+	return user, err
+}
+
+// userPayload serializes every column of a user, the password hash
+// included, which models.User keeps out of json
+type userPayload struct {
+	*models.User
+}
+
+type payloadFields struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Password  string     `json:"password"`
+}
+
+func (p userPayload) MarshalJSON() ([]byte, error) {
+	u := p.User
+	return json.Marshal(payloadFields{u.ID, u.CreatedAt, u.UpdatedAt, u.DeletedAt, u.Username, u.Email, u.Password})
+}
+
+func (p *userPayload) UnmarshalJSON(b []byte) error {
+	f := payloadFields{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	u := p.User
+	u.ID, u.CreatedAt, u.UpdatedAt, u.DeletedAt = f.ID, f.CreatedAt, f.UpdatedAt, f.DeletedAt
+	u.Username, u.Email, u.Password = f.Username, f.Email, f.Password
+	return nil
+}
+
+// Enqueue adds an entry per target for the user, tx should be the
+// transaction that inserted the user so both commit or neither does
+func Enqueue(tx *gorm.DB, user models.User, targets []string) error {
+	payload, err := json.Marshal(userPayload{&user})
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		entry := Entry{Target: target, Payload: string(payload), NextAttemptAt: time.Now()}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store reads and updates the outbox of one database
+type Store struct {
+	db *gorm.DB
+}
+
+// NewStore for the outbox table of db
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+// Due returns up to limit undelivered entries whose next attempt is due
+func (s *Store) Due(limit int) (entries []Entry, err error) {
+	err = s.db.Where("delivered_at IS NULL AND next_attempt_at <= ?", time.Now()).
+		Order("id asc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+// Pending returns up to limit undelivered entries, due or not
+func (s *Store) Pending(limit int) (entries []Entry, err error) {
+	err = s.db.Where("delivered_at IS NULL").Order("id asc").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+// PendingCount is the number of undelivered entries
+func (s *Store) PendingCount() (n int, err error) {
+	err = s.db.Model(&Entry{}).Where("delivered_at IS NULL").Count(&n).Error
+	return n, err
+}
+
+// Delivered marks the entry as written to its target
+func (s *Store) Delivered(e Entry) error {
+	return s.db.Model(&e).UpdateColumns(map[string]interface{}{
+		"attempts":     e.Attempts + 1,
+		"delivered_at": time.Now(),
+		"last_error":   "",
+	}).Error
+}
+
+// Failed records a failed attempt and pushes the next one back
+// exponentially
+func (s *Store) Failed(e Entry, cause error) error {
+	attempts := e.Attempts + 1
+	backoff := MaxBackoff
+	if attempts < 20 {
+		if b := time.Duration(1<<uint(attempts)) * time.Second; b < MaxBackoff {
+			backoff = b
+		}
+	}
+	message := cause.Error()
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	common.Logger.Warnf("outbox entry %d for %s failed %d times, retrying in %s: %s", e.ID, e.Target, attempts, backoff, message)
+	return s.db.Model(&e).UpdateColumns(map[string]interface{}{
+		"attempts":        attempts,
+		"last_error":      message,
+		"next_attempt_at": time.Now().Add(backoff),
+	}).Error
+}
@@ -0,0 +1,96 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+)
+
+var (
+	deliveries = common.NewCounter("outbox_deliveries_total",
+		"Outbox entries delivered to, or failed against, their target.", "target", "outcome")
+)
+
+// Relay delivers the due outbox entries in the background
+type Relay struct {
+	// Store is the outbox to read, it is looked up on every run so a
+	// database that comes up late is picked up
+	Store func() (*Store, error)
+	// Deliver writes the user to the target, it must succeed when the
+	// target already has the user so entries can be delivered twice
+	Deliver func(target string, user models.User) error
+	// Interval between two runs when nothing kicks the relay
+	Interval time.Duration
+	// BatchSize is the most entries delivered per run
+	BatchSize int
+	// AfterDelivery, when set, is called after a run that wrote users to
+	// their targets, once their entries are marked delivered
+	AfterDelivery func()
+
+	kick chan struct{}
+}
+
+// Kick runs the relay now instead of waiting for the interval
+func (r *Relay) Kick() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the relay until the process exits
+func (r *Relay) Start() {
+	r.kick = make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.kick:
+			}
+			r.RunOnce()
+		}
+	}()
+}
+
+// RunOnce delivers one batch of due entries and returns how many were
+// delivered
+func (r *Relay) RunOnce() int {
+	store, err := r.Store()
+	if err != nil {
+		common.Logger.Debug("outbox relay waiting for its database: ", err)
+		return 0
+	}
+	entries, err := store.Due(r.BatchSize)
+	if err != nil {
+		common.Logger.Error("could not read the outbox: ", err)
+		return 0
+	}
+	delivered, written := 0, false
+	for _, entry := range entries {
+		user, err := entry.User()
+		if err == nil {
+			err = r.Deliver(entry.Target, user)
+		}
+		if err != nil {
+			deliveries.Inc(entry.Target, "error")
+			if err := store.Failed(entry, err); err != nil {
+				common.Logger.Error("could not record the outbox failure: ", err)
+			}
+			continue
+		}
+		deliveries.Inc(entry.Target, "ok")
+		written = true
+		if err := store.Delivered(entry); err != nil {
+			common.Logger.Error("could not mark the outbox entry delivered: ", err)
+			continue
+		}
+		delivered++
+	}
+	if written && r.AfterDelivery != nil {
+		r.AfterDelivery()
+	}
+	return delivered
+}
@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cp16net/hod-test-app/common"
+)
+
+var (
+	// SSLMode overrides the sslmode given by the binding. Without either,
+	// connections are verified against the root CA when there is one and
+	// are unencrypted otherwise.
+	SSLMode string
+
+	// SSLRootCert overrides the root CA given by the binding, as a path or
+	// an inline PEM certificate
+	SSLRootCert string
+)
+
+// passthroughOptions are copied from the binding into the dsn as is
+var passthroughOptions = []string{"connect_timeout", "application_name", "sslcert", "sslkey"}
+
+// connectionString builds a lib/pq key/value dsn from the binding, which
+// may hand out a uri, a jdbcUrl or discrete fields
+func connectionString(svc *common.Service) (string, error) {
+	params := map[string]string{
+		"host":     svc.Host(),
+		"port":     svc.Port(),
+		"user":     svc.Username(),
+		"password": svc.Password(),
+		"dbname":   svc.Database(),
+	}
+	for _, key := range passthroughOptions {
+		params[key], _ = svc.Option(key)
+	}
+
+	mode := SSLMode
+	if mode == "" {
+		mode, _ = svc.Option("sslmode")
+	}
+	rootCert := SSLRootCert
+	if rootCert == "" {
+		rootCert, _ = svc.Option("sslrootcert")
+	}
+	if rootCert == "" {
+		rootCert, _ = svc.Credential("ca_certificate", "ca_cert")
+	}
+	if rootCert != "" {
+		path, err := rootCertFile(rootCert)
+		if err != nil {
+			return "", err
+		}
+		params["sslrootcert"] = path
+		if mode == "" {
+			mode = "verify-ca"
+		}
+	}
+	if mode == "" {
+		mode = "disable"
+	}
+	params["sslmode"] = mode
+
+	keys := make([]string, 0, len(params))
+	for key, value := range params {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + quoteDSNValue(params[key])
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// quoteDSNValue single quotes a value so spaces, quotes and backslashes
+// survive the key/value format
+func quoteDSNValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+	return "'" + v + "'"
+}
+
+// rootCertFiles are the files inline certificates were written to by this
+// process, by certificate
+var rootCertFiles = struct {
+	sync.Mutex
+	byCert map[string]string
+}{byCert: map[string]string{}}
+
+// rootCertFile returns a path lib/pq can read the root CA from, writing an
+// inline PEM certificate out to a new file of its own. Files are never
+// shared through a predictable name, which anyone able to write to the temp
+// directory could plant first.
+func rootCertFile(cert string) (string, error) {
+	if !strings.Contains(cert, "-----BEGIN") {
+		return cert, nil
+	}
+	rootCertFiles.Lock()
+	defer rootCertFiles.Unlock()
+	if path, ok := rootCertFiles.byCert[cert]; ok {
+		return path, nil
+	}
+	f, err := ioutil.TempFile("", "postgres-root-ca-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(cert)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	rootCertFiles.byCert[cert] = f.Name()
+	return f.Name(), nil
+}
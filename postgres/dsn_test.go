@@ -0,0 +1,104 @@
+package postgres
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cp16net/hod-test-app/common"
+)
+
+const testCert = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func dsn(t *testing.T, creds map[string]interface{}) string {
+	got, err := connectionString(&common.Service{Name: "pg", Credentials: creds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestConnectionString(t *testing.T) {
+	got := dsn(t, map[string]interface{}{
+		"uri": "postgres://u:p@db.example.com:5432/app?sslmode=require&connect_timeout=5",
+	})
+	want := "connect_timeout='5' dbname='app' host='db.example.com' password='p' port='5432' sslmode='require' user='u'"
+	if got != want {
+		t.Errorf("uri:\n got %s\nwant %s", got, want)
+	}
+
+	got = dsn(t, map[string]interface{}{"jdbcUrl": "jdbc:postgresql://db:5433/app?user=u&password=p"})
+	want = "dbname='app' host='db' password='p' port='5433' sslmode='disable' user='u'"
+	if got != want {
+		t.Errorf("jdbc url:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestConnectionStringFields(t *testing.T) {
+	got := dsn(t, map[string]interface{}{
+		"hostname": "db", "port": "5432", "username": "u", "password": `it's a \ pass`, "name": "app",
+	})
+	if !strings.Contains(got, `password='it\'s a \\ pass'`) {
+		t.Errorf("password not quoted: %s", got)
+	}
+	if !strings.HasPrefix(got, "dbname='app' host='db' ") {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestConnectionStringRootCert(t *testing.T) {
+	// a root certificate without a mode asks for the certificate to be checked
+	got := dsn(t, map[string]interface{}{"uri": "postgres://u@db/app?sslrootcert=/etc/ca.pem"})
+	if !strings.Contains(got, "sslmode='verify-ca'") || !strings.Contains(got, "sslrootcert='/etc/ca.pem'") {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestConnectionStringOverrides(t *testing.T) {
+	defer func(mode, cert string) { SSLMode, SSLRootCert = mode, cert }(SSLMode, SSLRootCert)
+	SSLMode, SSLRootCert = "verify-full", "/etc/override.pem"
+	svc := &common.Service{Credentials: map[string]interface{}{
+		"uri": "postgres://u@db/app?sslmode=require&sslrootcert=/etc/ca.pem",
+	}}
+	got, err := connectionString(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "sslmode='verify-full'") || !strings.Contains(got, "sslrootcert='/etc/override.pem'") {
+		t.Errorf("overrides not applied: %s", got)
+	}
+}
+
+func TestRootCertFile(t *testing.T) {
+	if path, err := rootCertFile("/etc/ca.pem"); err != nil || path != "/etc/ca.pem" {
+		t.Errorf("a path is kept as is: got %q, %v", path, err)
+	}
+
+	path, err := rootCertFile(testCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("the certificate file can be read by others: %s", info.Mode())
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != testCert {
+		t.Errorf("file holds %q", data)
+	}
+	if again, _ := rootCertFile(testCert); again != path {
+		t.Errorf("the same certificate was written again to %s", again)
+	}
+	other, err := rootCertFile(testCert + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(other)
+	if other == path {
+		t.Error("two certificates share a file")
+	}
+}
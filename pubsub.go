@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sseKeepAlive is how often an idle stream sends a comment, so proxies on
+// the way do not close it
+const sseKeepAlive = 15 * time.Second
+
+// Limits of the names of channels and of chat messages
+const (
+	maxChannelName = 200
+	maxChatMessage = 4096
+	maxSubscribeTo = 10
+)
+
+// maxUserStreams is how many streams a user may have open on an instance,
+// each one holds one of the redis.MaxSubscriptions of the instance
+const maxUserStreams = 4
+
+// userStreams counts the open streams of each user on this instance
+var userStreams = struct {
+	sync.Mutex
+	byUser map[string]int
+}{byUser: map[string]int{}}
+
+// openStream takes one of the streams of the user, it fails once the user
+// has maxUserStreams open
+func openStream(user string) bool {
+	userStreams.Lock()
+	defer userStreams.Unlock()
+	if userStreams.byUser[user] >= maxUserStreams {
+		return false
+	}
+	userStreams.byUser[user]++
+	return true
+}
+
+func closeStream(user string) {
+	userStreams.Lock()
+	defer userStreams.Unlock()
+	if userStreams.byUser[user]--; userStreams.byUser[user] <= 0 {
+		delete(userStreams.byUser, user)
+	}
+}
+
+// defaultChannel is subscribed to when the stream is not given any
+const defaultChannel = "chat"
+
+// ChatMessage is the payload the pubsub page publishes
+type ChatMessage struct {
+	From     string    `json:"from"`
+	Instance string    `json:"instance"`
+	Text     string    `json:"text"`
+	Sent     time.Time `json:"sent"`
+}
+
+// PubSubEvent is a message as it is streamed to the browser. Chat holds
+// the decoded payload when it was published by this app, messages from
+// anywhere else only have the raw payload.
+type PubSubEvent struct {
+	redis.Message
+	Chat       *ChatMessage `json:"chat,omitempty"`
+	ReceivedBy string       `json:"received_by"`
+	Received   time.Time    `json:"received"`
+}
+
+func validChannel(name string) error {
+	if name == "" {
+		return errors.New("channel is required")
+	}
+	if len(name) > maxChannelName {
+		return fmt.Errorf("channel names are at most %d bytes", maxChannelName)
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("channel %q has white space in it", name)
+	}
+	return nil
+}
+
+// subscribeTo reads ?channel= and ?pattern=, both can be repeated or hold
+// a comma separated list
+func subscribeTo(r *http.Request) (channels, patterns []string, err error) {
+	q := r.URL.Query()
+	split := func(values []string) ([]string, error) {
+		var names []string
+		for _, v := range values {
+			for _, name := range strings.Split(v, ",") {
+				name = strings.TrimSpace(name)
+				if name == "" {
+					continue
+				}
+				if err := validChannel(name); err != nil {
+					return nil, err
+				}
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	if channels, err = split(q["channel"]); err != nil {
+		return nil, nil, err
+	}
+	if patterns, err = split(q["pattern"]); err != nil {
+		return nil, nil, err
+	}
+	if len(channels)+len(patterns) > maxSubscribeTo {
+		return nil, nil, fmt.Errorf("subscribe to at most %d channels and patterns", maxSubscribeTo)
+	}
+	if len(channels) == 0 && len(patterns) == 0 {
+		channels = []string{defaultChannel}
+	}
+	return channels, patterns, nil
+}
+
+// publishChat sends the text to the channel as the logged in user
+func publishChat(r *http.Request, channel, text string) (int64, error) {
+	msg := ChatMessage{Instance: instanceIndex(), Text: text, Sent: time.Now().UTC()}
+	if s, ok := currentSession(r); ok {
+		msg.From = s.Username
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Publish(channel, string(payload))
+}
+
+// writeEvent sends one server-sent event, data must not hold a newline
+func writeEvent(w http.ResponseWriter, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// streamHandler subscribes to the channels and patterns of the query and
+// streams what they get as server-sent events until the client goes away.
+// It is behind a login so every stream belongs to a user, who may only
+// hold a few of the subscriptions of the instance.
+func streamHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		renderAPIError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	channels, patterns, err := subscribeTo(r)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	s, _ := currentSession(r)
+	user := s.Backend + ":" + strconv.FormatUint(uint64(s.UserID), 10)
+	if !openStream(user) {
+		renderAPIError(w, http.StatusTooManyRequests, fmt.Errorf("at most %d streams can be open at once, close one first", maxUserStreams))
+		return
+	}
+	defer closeStream(user)
+	sub, err := redis.Subscribe(channels, patterns)
+	if err == redis.ErrTooManySubscriptions {
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep nginx in front of the platform router from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	hello, _ := json.Marshal(map[string]interface{}{
+		"channels": channels, "patterns": patterns, "instance": instanceIndex(),
+	})
+	writeEvent(w, "subscribed", hello)
+	flusher.Flush()
+
+	messages := make(chan redis.Message)
+	go func() {
+		defer close(messages)
+		for {
+			msg, err := sub.Receive()
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			event := PubSubEvent{Message: msg, ReceivedBy: instanceIndex(), Received: time.Now().UTC()}
+			chat := ChatMessage{}
+			if json.Unmarshal([]byte(msg.Payload), &chat) == nil && chat.Text != "" {
+				event.Chat = &chat
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				common.Logger.Error(err)
+				continue
+			}
+			if err := writeEvent(w, "message", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// PubSubData for the pubsub page
+type PubSubData struct {
+	Channel  string
+	Instance string
+}
+
+func pubsubHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := redis.Ready(); err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	renderTemplate(w, "templates/pubsub.html", PubSubData{Channel: defaultChannel, Instance: instanceIndex()})
+}
+
+// APIPublish is a chat message for a channel
+type APIPublish struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+	// Receivers is how many subscriptions got the message
+	Receivers int64 `json:"receivers"`
+}
+
+// Validate checks the channel and the message can be published
+func (p APIPublish) Validate() error {
+	if err := validChannel(p.Channel); err != nil {
+		return err
+	}
+	if p.Message == "" {
+		return errors.New("message is required")
+	}
+	if len(p.Message) > maxChatMessage {
+		return fmt.Errorf("messages are at most %d bytes", maxChatMessage)
+	}
+	return nil
+}
+
+func apiPublishHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APIPublish{}
+	if err := decodeJSON(r, &body); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := body.Validate(); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := publishChat(r, body.Channel, body.Message)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	body.Receivers = n
+	renderJSON(w, http.StatusOK, body)
+}
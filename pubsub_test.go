@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestUserStreams(t *testing.T) {
+	for i := 0; i < maxUserStreams; i++ {
+		if !openStream("sqlite:1") {
+			t.Fatalf("stream %d refused", i+1)
+		}
+	}
+	if openStream("sqlite:1") {
+		t.Error("a stream past the limit was opened")
+	}
+	if !openStream("sqlite:2") {
+		t.Error("another user was refused")
+	}
+	closeStream("sqlite:1")
+	if !openStream("sqlite:1") {
+		t.Error("a closed stream was not given back")
+	}
+	for i := 0; i < maxUserStreams; i++ {
+		closeStream("sqlite:1")
+	}
+	closeStream("sqlite:2")
+	if len(userStreams.byUser) != 0 {
+		t.Errorf("streams left open: %v", userStreams.byUser)
+	}
+}
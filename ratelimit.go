@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/bsm/ratelimit.v1"
+)
+
+// quota of requests a client may make to an action in a period, a rate of
+// 0 is unlimited
+type quota struct {
+	Rate int
+	Per  time.Duration
+}
+
+// parseQuota reads a quota written as requests/period, like 5/1m
+func parseQuota(s string) (quota, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return quota{}, fmt.Errorf("quota %q is not written as requests/period", s)
+	}
+	rate, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || rate < 0 {
+		return quota{}, fmt.Errorf("quota %q does not start with a number of requests", s)
+	}
+	per, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || per < time.Second {
+		return quota{}, fmt.Errorf("quota %q needs a period of at least 1s", s)
+	}
+	return quota{Rate: rate, Per: per}, nil
+}
+
+func (q quota) String() string {
+	return fmt.Sprintf("%d/%s", q.Rate, q.Per)
+}
+
+var (
+	// defaultQuota applies to every action without a quota of its own
+	defaultQuota = quota{Rate: 30, Per: time.Minute}
+	// quotas of the actions that cost the most, writing logs and fibonacci
+	// numbers keep the workers busy long after the request is answered
+	quotas = map[string]quota{
+		actionLogsGenerate: {Rate: 5, Per: time.Minute},
+		actionRabbitmqFib:  {Rate: 10, Per: time.Minute},
+		actionSQLLoad:      {Rate: 2, Per: time.Minute},
+		// accounts are cheap to make and each one can change data
+		actionUserSignup: {Rate: 5, Per: time.Hour},
+		// enough for typos, too few to guess passwords
+		actionUserLogin: {Rate: 10, Per: time.Minute},
+	}
+
+	rateLimited = common.NewCounter("rate_limited_total",
+		"Requests refused for going over a quota, by action.", "action")
+)
+
+// setupRateLimits reads the quotas from the configuration
+func setupRateLimits(c Config) error {
+	q, err := parseQuota(c.RateLimit)
+	if err != nil {
+		return err
+	}
+	defaultQuota = q
+	for action, s := range c.RateLimits {
+		if !knownAction(action) {
+			return fmt.Errorf("unknown action %q in the rate limits", action)
+		}
+		if quotas[action], err = parseQuota(s); err != nil {
+			return fmt.Errorf("%s: %s", action, err)
+		}
+	}
+	return nil
+}
+
+func knownAction(action string) bool {
+	for _, a := range auditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func quotaOf(action string) quota {
+	if q, ok := quotas[action]; ok {
+		return q
+	}
+	return defaultQuota
+}
+
+// localLimiter is a client's quota counted in this instance alone
+type localLimiter struct {
+	*ratelimit.RateLimiter
+	per  time.Duration
+	used time.Time
+}
+
+// localLimiters take over while redis is unavailable, by action and client.
+// Limiters left unused for a whole period are full again and get dropped.
+var localLimiters = struct {
+	sync.Mutex
+	byKey map[string]*localLimiter
+	swept time.Time
+}{byKey: map[string]*localLimiter{}}
+
+// allowLocally takes a request from the in-process quota of key
+func allowLocally(key string, q quota) (bool, time.Duration) {
+	localLimiters.Lock()
+	defer localLimiters.Unlock()
+	now := time.Now()
+	if now.Sub(localLimiters.swept) > time.Minute {
+		for k, l := range localLimiters.byKey {
+			if now.Sub(l.used) > l.per {
+				delete(localLimiters.byKey, k)
+			}
+		}
+		localLimiters.swept = now
+	}
+	l, ok := localLimiters.byKey[key]
+	if !ok {
+		l = &localLimiter{RateLimiter: ratelimit.New(q.Rate, q.Per), per: q.Per}
+		localLimiters.byKey[key] = l
+	}
+	l.used = now
+	if l.Limit() {
+		// a request is given back every period/rate
+		return false, q.Per / time.Duration(q.Rate)
+	}
+	return true, 0
+}
+
+// allow counts the request of the client against the quota of the action
+// across every instance, or in this instance while redis is unavailable.
+// A refused request should be retried after retryAfter.
+func allow(action, client string, q quota) (ok bool, retryAfter time.Duration) {
+	key := action + ":" + client
+	hits, reset, err := redis.CountHit(key, q.Per)
+	if err != nil {
+		if !common.IsUnavailable(err) {
+			common.Logger.Error(err)
+		}
+		return allowLocally(key, q)
+	}
+	if hits > int64(q.Rate) {
+		return false, time.Until(reset)
+	}
+	return true, 0
+}
+
+// limited answers 429 with Retry-After once a client, told apart by its
+// IP, went over the quota of the action
+func limited(action string, h httprouter.Handle) httprouter.Handle {
+	q := quotaOf(action)
+	if q.Rate == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ok, retryAfter := allow(action, clientIP(r), q)
+		if ok {
+			h(w, r, ps)
+			return
+		}
+		rateLimited.Inc(action)
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		err := fmt.Errorf("over the quota of %s for %s, try again in %ds", q, action, seconds)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			renderAPIError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	}
+}
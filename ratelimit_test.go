@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestLimitedIgnoresSpoofedForwardedFor(t *testing.T) {
+	defer func(q quota) { quotas[actionRabbitmqFib] = q }(quotaOf(actionRabbitmqFib))
+	defer func(n int) { trustedProxies = n }(trustedProxies)
+	quotas[actionRabbitmqFib] = quota{Rate: 2, Per: time.Hour}
+	trustedProxies = 1
+	h := limited(actionRabbitmqFib, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {})
+
+	// redis is not bound in the tests, the quota is counted in this process
+	status := func(fwd string) int {
+		r := httptest.NewRequest("POST", "/rabbitmq/fib", nil)
+		r.RemoteAddr = "10.0.0.9:51234"
+		r.Header.Set("X-Forwarded-For", fwd+", 198.51.100.4")
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w.Code
+	}
+	for i, fwd := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		want := http.StatusOK
+		if i >= 2 {
+			want = http.StatusTooManyRequests
+		}
+		if got := status(fwd); got != want {
+			t.Errorf("request %d claiming to come from %s: got %d, want %d", i+1, fwd, got, want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"gopkg.in/redis.v4"
+)
+
+// Types of redis values
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+// DefaultCount and MaxCount size a page of keys or of the items of a value.
+// SCAN takes the count as a hint, a page can be shorter or a bit longer.
+const (
+	DefaultCount = 50
+	MaxCount     = 1000
+)
+
+// ClampCount gives the default for counts below one and caps the rest
+func ClampCount(count int64) int64 {
+	if count < 1 {
+		return DefaultCount
+	}
+	if count > MaxCount {
+		return MaxCount
+	}
+	return count
+}
+
+// KeyInfo describes a key without reading its value
+type KeyInfo struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	// TTL in seconds, -1 when the key does not expire
+	TTL int64 `json:"ttl"`
+	// Size is the length of a string or the number of items of the others
+	Size int64 `json:"size"`
+}
+
+// KeyPage is a page of a SCAN, Next is zero once every key was seen
+type KeyPage struct {
+	Match  string    `json:"match,omitempty"`
+	Cursor uint64    `json:"cursor"`
+	Next   uint64    `json:"next"`
+	Keys   []KeyInfo `json:"keys"`
+}
+
+// ScanKeys reads one page of the keys matching the pattern, every key when
+// it is empty, starting at the cursor
+func ScanKeys(cursor uint64, match string, count int64) (page KeyPage, err error) {
+	defer common.ObserveCall("redis", "ScanKeys", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return page, err
+	}
+	page = KeyPage{Match: match, Cursor: cursor, Keys: []KeyInfo{}}
+	keys, next, err := client.Scan(cursor, match, ClampCount(count)).Result()
+	if err != nil {
+		return page, err
+	}
+	page.Next = next
+	infos, err := describe(keys)
+	if err != nil {
+		return page, err
+	}
+	page.Keys = infos
+	return page, nil
+}
+
+// describe looks up the type, ttl, encoding and size of the keys in two
+// round trips, leaving out keys that are gone by then
+func describe(keys []string) ([]KeyInfo, error) {
+	infos := make([]KeyInfo, 0, len(keys))
+	if len(keys) == 0 {
+		return infos, nil
+	}
+	types := make([]*redis.StatusCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	encodings := make([]*redis.StringCmd, len(keys))
+	// a key deleted in the meantime fails its OBJECT ENCODING, which is
+	// told apart by its type below rather than failing the whole page
+	_, err := client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range keys {
+			types[i] = pipe.Type(key)
+			ttls[i] = pipe.TTL(key)
+			encodings[i] = pipe.ObjectEncoding(key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if types[i].Err() != nil {
+			return nil, types[i].Err()
+		}
+		if types[i].Val() == "none" {
+			continue
+		}
+		info := KeyInfo{Key: key, Type: types[i].Val(), Encoding: encodings[i].Val(), TTL: -1}
+		if ttl := ttls[i].Val(); ttl >= 0 {
+			info.TTL = int64(ttl / time.Second)
+		}
+		infos = append(infos, info)
+	}
+
+	sizes := make([]*redis.IntCmd, len(infos))
+	_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, info := range infos {
+			sizes[i] = sizeOf(pipe, info)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i := range infos {
+		if sizes[i] != nil {
+			infos[i].Size = sizes[i].Val()
+		}
+	}
+	return infos, nil
+}
+
+// sizeOf queues the command that counts the value of the key, nil for
+// types it does not know
+func sizeOf(pipe *redis.Pipeline, info KeyInfo) *redis.IntCmd {
+	switch info.Type {
+	case TypeString:
+		return pipe.StrLen(info.Key)
+	case TypeHash:
+		return pipe.HLen(info.Key)
+	case TypeList:
+		return pipe.LLen(info.Key)
+	case TypeSet:
+		return pipe.SCard(info.Key)
+	case TypeZSet:
+		return pipe.ZCard(info.Key)
+	}
+	return nil
+}
+
+// Field of a hash
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Member of a sorted set
+type Member struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// KeyValue is a key with a page of its value. Strings are read whole, hashes
+// and sets are scanned from Cursor to Next, lists and sorted sets are read
+// by index from Cursor to Next. Types without a viewer, like streams, only
+// come with their KeyInfo.
+type KeyValue struct {
+	KeyInfo
+	Value   string   `json:"value,omitempty"`
+	Fields  []Field  `json:"fields,omitempty"`
+	Items   []string `json:"items,omitempty"`
+	Members []Member `json:"members,omitempty"`
+	Cursor  uint64   `json:"cursor"`
+	Next    uint64   `json:"next"`
+}
+
+// Paged reports whether the value comes in pages
+func (v KeyValue) Paged() bool {
+	switch v.Type {
+	case TypeHash, TypeList, TypeSet, TypeZSet:
+		return true
+	}
+	return false
+}
+
+// Index of the i-th item of a page of a list
+func (v KeyValue) Index(i int) uint64 {
+	return v.Cursor + uint64(i)
+}
+
+// ReadKey reads the key and a page of its value, from cursor for hashes
+// and sets and from that index for lists and sorted sets
+func ReadKey(key string, cursor uint64, count int64) (v KeyValue, err error) {
+	defer common.ObserveCall("redis", "ReadKey", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return v, err
+	}
+	infos, err := describe([]string{key})
+	if err != nil {
+		return v, err
+	}
+	if len(infos) == 0 {
+		return v, ErrKeyNotFound
+	}
+	v = KeyValue{KeyInfo: infos[0], Cursor: cursor}
+	count = ClampCount(count)
+	switch v.Type {
+	case TypeString:
+		v.Value, err = client.Get(key).Result()
+	case TypeHash:
+		var page []string
+		page, v.Next, err = client.HScan(key, cursor, "", count).Result()
+		// HSCAN answers with the name and the value of each field in turn
+		for i := 0; i+1 < len(page); i += 2 {
+			v.Fields = append(v.Fields, Field{Name: page[i], Value: page[i+1]})
+		}
+	case TypeSet:
+		v.Items, v.Next, err = client.SScan(key, cursor, "", count).Result()
+	case TypeList:
+		v.Items, err = client.LRange(key, int64(cursor), int64(cursor)+count-1).Result()
+		v.Next = nextIndex(cursor, count, v.Size)
+	case TypeZSet:
+		var zs []redis.Z
+		zs, err = client.ZRangeWithScores(key, int64(cursor), int64(cursor)+count-1).Result()
+		for _, z := range zs {
+			v.Members = append(v.Members, Member{Member: fmt.Sprint(z.Member), Score: z.Score})
+		}
+		v.Next = nextIndex(cursor, count, v.Size)
+	}
+	if err == redis.Nil {
+		// the key went away between the two reads
+		return v, ErrKeyNotFound
+	}
+	return v, err
+}
+
+// nextIndex after a page of an indexed value, zero after the last page
+// like a SCAN cursor
+func nextIndex(start uint64, count, size int64) uint64 {
+	if next := int64(start) + count; next < size {
+		return uint64(next)
+	}
+	return 0
+}
+
+// Delete removes the key, ErrKeyNotFound when there was none
+func Delete(key string) (err error) {
+	defer common.ObserveCall("redis", "Delete", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	n, err := client.Del(key).Result()
+	if err == nil && n == 0 {
+		return ErrKeyNotFound
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"gopkg.in/redis.v4"
+)
+
+// cachePrefix of the keys of every cache
+const cachePrefix = "cache:"
+
+var cacheLookups = common.NewCounter("cache_lookups_total",
+	"Lookups in the redis caches, by cache and result (hit, miss or error).", "cache", "result")
+
+// Cache is a namespace of values kept in redis for TTL. Invalidate drops
+// every value at once by moving the cache to a new generation, the values
+// of the old one are never read again and expire on their own.
+type Cache struct {
+	Name string
+	// TTL of the values, the cache is disabled when it is 0
+	TTL time.Duration
+}
+
+// NewCache creates the cache, it is shared by every instance using the
+// same name
+func NewCache(name string, ttl time.Duration) *Cache {
+	return &Cache{Name: name, TTL: ttl}
+}
+
+// Enabled reports whether values are cached at all
+func (c *Cache) Enabled() bool {
+	return c.TTL > 0
+}
+
+func (c *Cache) generationKey() string {
+	return cachePrefix + c.Name + ":generation"
+}
+
+// CacheItem is the result of a lookup. On a miss Set stores the value
+// under the generation the lookup saw, so a value computed while the cache
+// was invalidated is dropped with the rest of that generation.
+type CacheItem struct {
+	Value []byte
+	Hit   bool
+	cache *Cache
+	key   string
+}
+
+// Get looks up key in the current generation of the cache
+func (c *Cache) Get(key string) (item *CacheItem, err error) {
+	defer common.ObserveCall("redis", "CacheGet", time.Now(), &err)
+	defer func() {
+		switch {
+		case err != nil:
+			cacheLookups.Inc(c.Name, "error")
+		case item.Hit:
+			cacheLookups.Inc(c.Name, "hit")
+		default:
+			cacheLookups.Inc(c.Name, "miss")
+		}
+	}()
+	if err := Ready(); err != nil {
+		return nil, err
+	}
+	gen, err := client.Get(c.generationKey()).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	item = &CacheItem{cache: c, key: cachePrefix + c.Name + ":" + strconv.FormatInt(gen, 10) + ":" + key}
+	item.Value, err = client.Get(item.key).Bytes()
+	if err == redis.Nil {
+		return item, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item.Hit = true
+	return item, nil
+}
+
+// Set stores the value of a missed item for the TTL of its cache
+func (i *CacheItem) Set(value []byte) (err error) {
+	defer common.ObserveCall("redis", "CacheSet", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	return client.Set(i.key, value, i.cache.TTL).Err()
+}
+
+// Invalidate drops every value of the cache, on every instance
+func (c *Cache) Invalidate() (err error) {
+	defer common.ObserveCall("redis", "CacheInvalidate", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	return client.Incr(c.generationKey()).Err()
+}
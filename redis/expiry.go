@@ -0,0 +1,174 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"gopkg.in/redis.v4"
+)
+
+// Limits of an expiry demo, the step is in seconds
+const (
+	MaxDemoKeys = 100
+	MaxDemoStep = 60
+)
+
+// ErrDemoNotFound is returned for a demo that is over or never ran
+var ErrDemoNotFound = errors.New("expiry demo not found")
+
+// demoPrefix of the keys of every expiry demo
+const demoPrefix = "expiry-demo:"
+
+// demoGrace keeps the description of a demo around after its last key
+// should have expired, so late expiries still show up
+const demoGrace = 5 * time.Minute
+
+// ExpiryDemo writes keys that expire one step apart and watches them go,
+// comparing when each key should expire with when redis removed it
+type ExpiryDemo struct {
+	ID   string `json:"id"`
+	Keys int    `json:"keys"`
+	// Step between the expiries in seconds
+	Step    int       `json:"step"`
+	Started time.Time `json:"started"`
+}
+
+// Key is the name of the i-th key of the demo, counted from 1
+func (d ExpiryDemo) Key(i int) string {
+	return demoPrefix + d.ID + ":" + strconv.Itoa(i)
+}
+
+// ExpiresAt is when the i-th key should expire
+func (d ExpiryDemo) ExpiresAt(i int) time.Time {
+	return d.Started.Add(d.ttl(i))
+}
+
+// ttl of the i-th key when the demo starts
+func (d ExpiryDemo) ttl(i int) time.Duration {
+	return time.Duration(i*d.Step) * time.Second
+}
+
+func (d ExpiryDemo) metaKey() string {
+	return demoPrefix + d.ID
+}
+
+// Validate checks the demo is within the limits
+func (d ExpiryDemo) Validate() error {
+	if d.Keys < 1 || d.Keys > MaxDemoKeys {
+		return fmt.Errorf("keys must be between 1 and %d", MaxDemoKeys)
+	}
+	if d.Step < 1 || d.Step > MaxDemoStep {
+		return fmt.Errorf("step must be between 1 and %d seconds", MaxDemoStep)
+	}
+	return nil
+}
+
+// ExpiringKey is how a key of the demo is doing
+type ExpiringKey struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// TTL left in milliseconds, -2 once the key is gone
+	TTL     int64 `json:"ttl_ms"`
+	Expired bool  `json:"expired"`
+	// Overdue keys are still there after they should have expired. Reading
+	// an expired key makes redis drop it, so this only shows up when expiry
+	// is broken, like a key persisted by hand or a clock jump.
+	Overdue bool `json:"overdue"`
+}
+
+// ExpiryStatus of a demo at a point in time
+type ExpiryStatus struct {
+	ExpiryDemo
+	At      time.Time     `json:"at"`
+	Expired int           `json:"expired"`
+	Overdue int           `json:"overdue"`
+	Entries []ExpiringKey `json:"entries"`
+}
+
+// Done reports whether every key of the demo is gone
+func (s ExpiryStatus) Done() bool {
+	return s.Expired == s.Keys
+}
+
+// StartExpiryDemo writes the keys of a new demo, the i-th one expiring after
+// i steps of seconds
+func StartExpiryDemo(keys, step int) (demo ExpiryDemo, err error) {
+	defer common.ObserveCall("redis", "StartExpiryDemo", time.Now(), &err)
+	demo = ExpiryDemo{Keys: keys, Step: step}
+	if err := demo.Validate(); err != nil {
+		return demo, err
+	}
+	if err := Ready(); err != nil {
+		return demo, err
+	}
+	demo.Started = time.Now().UTC()
+	demo.ID = strconv.FormatInt(demo.Started.UnixNano(), 36)
+	meta, err := json.Marshal(demo)
+	if err != nil {
+		return demo, err
+	}
+	_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.Set(demo.metaKey(), meta, demo.ttl(keys)+demoGrace)
+		for i := 1; i <= keys; i++ {
+			pipe.Set(demo.Key(i), demo.ExpiresAt(i).Format(time.RFC3339), demo.ttl(i))
+		}
+		return nil
+	})
+	return demo, err
+}
+
+// GetExpiryStatus looks up which keys of the demo are gone
+func GetExpiryStatus(id string) (status ExpiryStatus, err error) {
+	defer common.ObserveCall("redis", "GetExpiryStatus", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return status, err
+	}
+	meta, err := client.Get(demoPrefix + id).Bytes()
+	if err == redis.Nil {
+		return status, ErrDemoNotFound
+	}
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(meta, &status.ExpiryDemo); err != nil {
+		return status, fmt.Errorf("invalid expiry demo %s: %s", id, err)
+	}
+	// the description is a plain key anyone can overwrite, it must not
+	// point at the keys of another demo or ask for more keys than a demo has
+	if status.ID != id {
+		return status, fmt.Errorf("invalid expiry demo %s: it describes demo %q", id, status.ID)
+	}
+	if err := status.ExpiryDemo.Validate(); err != nil {
+		return status, fmt.Errorf("invalid expiry demo %s: %s", id, err)
+	}
+	ttls := make([]*redis.DurationCmd, status.Keys)
+	_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i := range ttls {
+			ttls[i] = pipe.PTTL(status.Key(i + 1))
+		}
+		return nil
+	})
+	if err != nil {
+		return status, err
+	}
+	status.At = time.Now().UTC()
+	status.Entries = make([]ExpiringKey, status.Keys)
+	for i, cmd := range ttls {
+		e := ExpiringKey{Key: status.Key(i + 1), ExpiresAt: status.ExpiresAt(i + 1)}
+		e.TTL = int64(cmd.Val() / time.Millisecond)
+		// PTTL answers -2 for a missing key, which is scaled like the rest
+		if cmd.Val() == -2*time.Millisecond {
+			e.TTL, e.Expired = -2, true
+			status.Expired++
+		} else if status.At.After(e.ExpiresAt) {
+			e.Overdue = true
+			status.Overdue++
+		}
+		status.Entries[i] = e
+	}
+	return status, nil
+}
@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"gopkg.in/redis.v4"
+)
+
+// MaxSubscriptions open at once on an app instance
+const MaxSubscriptions = 32
+
+// ErrTooManySubscriptions is returned when every subscription is taken
+var ErrTooManySubscriptions = errors.New("too many redis subscriptions, try again later")
+
+// subscriptions limits the open subscriptions to MaxSubscriptions, so one
+// more fails right away instead of waiting on the pool
+var subscriptions = make(chan struct{}, MaxSubscriptions)
+
+// Message published on a channel. Pattern is the pattern it matched, empty
+// when it came through a channel subscription.
+type Message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// Subscription to channels and patterns, it holds a connection of its own
+// until it is closed
+type Subscription struct {
+	ps    *redis.PubSub
+	close sync.Once
+}
+
+// Publish sends the message to the channel, returning how many
+// subscriptions got it across every instance
+func Publish(channel, message string) (receivers int64, err error) {
+	defer common.ObserveCall("redis", "Publish", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return 0, err
+	}
+	return client.Publish(channel, message).Result()
+}
+
+// Subscribe to the channels and the patterns, at least one of them is
+// needed
+func Subscribe(channels, patterns []string) (sub *Subscription, err error) {
+	defer common.ObserveCall("redis", "Subscribe", time.Now(), &err)
+	if len(channels) == 0 && len(patterns) == 0 {
+		return nil, errors.New("subscribe to at least one channel or pattern")
+	}
+	if err := Ready(); err != nil {
+		return nil, err
+	}
+	select {
+	case subscriptions <- struct{}{}:
+	default:
+		return nil, ErrTooManySubscriptions
+	}
+	var ps *redis.PubSub
+	if len(channels) > 0 {
+		ps, err = subscriber.Subscribe(channels...)
+		if err == nil && len(patterns) > 0 {
+			err = ps.PSubscribe(patterns...)
+		}
+	} else {
+		ps, err = subscriber.PSubscribe(patterns...)
+	}
+	if err != nil {
+		ps.Close()
+		<-subscriptions
+		return nil, err
+	}
+	return &Subscription{ps: ps}, nil
+}
+
+// Receive waits for the next message, reconnecting and subscribing again
+// when the connection drops. It fails once the subscription is closed.
+func (s *Subscription) Receive() (Message, error) {
+	msg, err := s.ps.ReceiveMessage()
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Channel: msg.Channel, Pattern: msg.Pattern, Payload: msg.Payload}, nil
+}
+
+// Close ends the subscription and gives back its connection, a Receive
+// waiting on it returns an error
+func (s *Subscription) Close() (err error) {
+	s.close.Do(func() {
+		err = s.ps.Close()
+		<-subscriptions
+	})
+	return err
+}
@@ -0,0 +1,37 @@
+package redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"gopkg.in/redis.v4"
+)
+
+// rateLimitPrefix of the counters of the rate limits
+const rateLimitPrefix = "ratelimit:"
+
+// CountHit counts a hit on key in the current window of length per, shared
+// by every instance. It returns how many hits the window has had so far,
+// this one included, and when the next window starts.
+func CountHit(key string, per time.Duration) (hits int64, reset time.Time, err error) {
+	defer common.ObserveCall("redis", "CountHit", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return 0, reset, err
+	}
+	now := time.Now()
+	window := now.UnixNano() / int64(per)
+	reset = time.Unix(0, (window+1)*int64(per))
+	counter := rateLimitPrefix + key + ":" + strconv.FormatInt(window, 10)
+	var incr *redis.IntCmd
+	_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+		incr = pipe.Incr(counter)
+		// keep the counter a little past its window for clocks that are off
+		pipe.PExpire(counter, reset.Sub(now)+time.Second)
+		return nil
+	})
+	if err != nil {
+		return 0, reset, err
+	}
+	return incr.Val(), reset, nil
+}
@@ -1,124 +1,138 @@
 package redis
 
 import (
-	"encoding/json"
-	"os"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/cp16net/hod-test-app/common"
 	"gopkg.in/redis.v4"
 )
 
-// Service Definition
-type Service struct {
-	Service []Redis `json:"cp16net-redis"`
-}
-
-// Redis Service Info
-type Redis struct {
-	Creds Credentials `json:"credentials"`
-}
-
-// Credentials for HavenOnDemand
-type Credentials struct {
-	User     string `json:"user"`
-	Username string `json:"username"`
-	Database string `json:"database"`
-	Host     string `json:"host"`
-	Hostname string `json:"hostname"`
-	Port     string `json:"port"`
-	Password string `json:"password"`
-}
-
-var envVcapServices = `
-{
-	"cp16net-redis": [
-		{
-			"credentials": {
-				"host": "localhost",
-                "hostname": "localhost",
-                "password": "",
-                "port": "6379",
-                "uri": "redis://:@localhost:6379/"
-			}
-		}
-	]
-}`
-
-var creds Credentials
-
-func setMysqlVcapServices() {
-	vcap := os.Getenv("VCAP_SERVICES")
-	if vcap == "" {
-		vcap = envVcapServices
-	}
-	var svc Service
-	if err := json.Unmarshal([]byte(vcap), &svc); err != nil {
-		common.Logger.Error(err)
-		panic("could not read vcap")
-	}
-	creds = svc.Service[0].Creds
-	return
-}
+// serviceName of the bound redis service
+const serviceName = "cp16net-redis"
 
-func dbConnection() *redis.Client {
+func dbConnection(poolSize int) (*redis.Client, error) {
 	common.Logger.Debug("Building connection to redis")
-	setMysqlVcapServices()
+	svc, err := common.FindService(serviceName)
+	if err != nil {
+		return nil, err
+	}
 	client := redis.NewClient(&redis.Options{
-		Addr:     creds.Host + ":" + creds.Port,
-		Password: creds.Password, // no password set
-		DB:       0,              // use default DB
+		Addr:     svc.HostPort("6379"),
+		Password: svc.Password(),
+		DB:       0, // use default DB
+		PoolSize: poolSize,
 	})
 	pong, err := client.Ping().Result()
 	if err != nil || pong != "PONG" {
 		common.Logger.Error(pong, err)
-		panic(err)
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
 	}
 	common.Logger.Debug("Connected to redis")
-	return client
+	return client, nil
 }
 
-func closeConnection(db *redis.Client) {
-	db.Close()
+// client is the pooled client shared by every request
+var client *redis.Client
+
+// subscriber holds the connections of the subscriptions apart from client,
+// each one keeps a connection for as long as it lasts
+var subscriber *redis.Client
+
+// setup opens the pools the first time redis is used
+var setup = common.NewLazy("redis", func() error {
+	c, err := dbConnection(common.PoolSize)
+	if err != nil {
+		return err
+	}
+	sub, err := dbConnection(MaxSubscriptions)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	client, subscriber = c, sub
+	return nil
+})
+
+// Ready initializes redis if needed and returns why it is unavailable
+func Ready() error {
+	return setup.Ready()
+}
+
+// Ping checks that redis answers on the shared client
+func Ping() error {
+	if err := Ready(); err != nil {
+		return err
+	}
+	return client.Ping().Err()
 }
 
-// Increment does just that
-func Increment() {
-	client := dbConnection()
-	defer closeConnection(client)
-	if err := client.Incr("counter").Err(); err != nil {
-		common.Logger.Error(err)
-		panic(err)
+// ErrKeyNotFound is returned when reading a key that does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// Increment does just that, returning the new count
+func Increment() (n int64, err error) {
+	defer common.ObserveCall("redis", "Increment", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return 0, err
 	}
+	return client.Incr("counter").Result()
 }
 
 // GetCount gets the current counter
-func GetCount() int64 {
-	client := dbConnection()
-	defer closeConnection(client)
-	n, _ := client.Get("counter").Int64()
-	return n
+func GetCount() (n int64, err error) {
+	defer common.ObserveCall("redis", "GetCount", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return 0, err
+	}
+	n, err = client.Get("counter").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
 }
 
-// ListKeys gets the list of all keys in db
-func ListKeys() []string {
-	client := dbConnection()
-	defer closeConnection(client)
-	n := client.Keys("*")
-	return n.Val()
+// Set just a simple set method for redis, the key expires after ttl unless
+// it is 0
+func Set(key, value string, ttl time.Duration) (err error) {
+	defer common.ObserveCall("redis", "Set", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	n := client.Set(key, value, ttl)
+	return n.Err()
 }
 
-// GetVal gets the value of the key out of the db
-func GetVal(key string) string {
-	client := dbConnection()
-	defer closeConnection(client)
-	n := client.Get(key)
-	return n.Val()
+// Expire sets the time to live of an existing key
+func Expire(key string, ttl time.Duration) (err error) {
+	defer common.ObserveCall("redis", "Expire", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	ok, err := client.Expire(key, ttl).Result()
+	if err == nil && !ok {
+		return ErrKeyNotFound
+	}
+	return err
 }
 
-// Set just a simple set method for redis
-func Set(key, value string) error {
-	client := dbConnection()
-	defer closeConnection(client)
-	n := client.Set(key, value, 0)
-	return n.Err()
+// Persist removes the time to live of a key, it is fine for the key to not
+// have one
+func Persist(key string) (err error) {
+	defer common.ObserveCall("redis", "Persist", time.Now(), &err)
+	if err := Ready(); err != nil {
+		return err
+	}
+	ok, err := client.Persist(key).Result()
+	if err != nil || ok {
+		return err
+	}
+	// PERSIST answers 0 for keys without a ttl as well as missing keys
+	exists, err := client.Exists(key).Result()
+	if err == nil && !exists {
+		return ErrKeyNotFound
+	}
+	return err
 }
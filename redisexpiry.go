@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Defaults of the expiry demo form
+const (
+	defaultDemoKeys = 10
+	defaultDemoStep = 2
+)
+
+// RedisExpiryData for the expiry demo page
+type RedisExpiryData struct {
+	Keys   int
+	Step   int
+	Status *redis.ExpiryStatus
+	Error  string
+}
+
+func newRedisExpiryData() RedisExpiryData {
+	return RedisExpiryData{Keys: defaultDemoKeys, Step: defaultDemoStep}
+}
+
+// redisExpiryHandler shows the form to start a demo, or how the demo of
+// ?demo= is doing. The page reloads itself until every key is gone.
+func redisExpiryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := newRedisExpiryData()
+	id := r.URL.Query().Get("demo")
+	if id == "" {
+		if err := redis.Ready(); err != nil {
+			renderUnavailable(w, "Redis", err)
+			return
+		}
+		renderTemplate(w, "templates/redisexpiry.html", data)
+		return
+	}
+	status, err := redis.GetExpiryStatus(id)
+	if err == redis.ErrDemoNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/redisexpiry.html", data)
+		return
+	}
+	if err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	data.Keys, data.Step, data.Status = status.Keys, status.Step, &status
+	renderTemplate(w, "templates/redisexpiry.html", data)
+}
+
+func redisExpiryStartHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := newRedisExpiryData()
+	keys, err := formInt(r, "keys")
+	if err == nil {
+		data.Keys = keys
+		data.Step, err = formInt(r, "step")
+	}
+	if err == nil {
+		err = redis.ExpiryDemo{Keys: data.Keys, Step: data.Step}.Validate()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/redisexpiry.html", data)
+		return
+	}
+	demo, err := redis.StartExpiryDemo(data.Keys, data.Step)
+	if err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	http.Redirect(w, r, redisExpiryURL(demo.ID), http.StatusFound)
+}
+
+// redisExpiryURL is the page of a running demo
+func redisExpiryURL(id string) string {
+	return "/redis/expiry?demo=" + url.QueryEscape(id)
+}
+
+// APIRedisExpiryRequest starts an expiry demo of keys expiring step seconds
+// apart
+type APIRedisExpiryRequest struct {
+	Keys int `json:"keys"`
+	Step int `json:"step"`
+}
+
+// apiRedisExpiryStartHandler starts a demo and answers with its first
+// status, poll /api/v1/redis/expiry/:id for the next ones
+func apiRedisExpiryStartHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APIRedisExpiryRequest{Keys: defaultDemoKeys, Step: defaultDemoStep}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &body); err != nil {
+			renderAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := (redis.ExpiryDemo{Keys: body.Keys, Step: body.Step}).Validate(); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	demo, err := redis.StartExpiryDemo(body.Keys, body.Step)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := redis.GetExpiryStatus(demo.ID)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/redis/expiry/"+url.PathEscape(demo.ID))
+	renderJSON(w, http.StatusCreated, status)
+}
+
+// apiRedisExpiryHandler is how a demo is doing right now
+func apiRedisExpiryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	status, err := redis.GetExpiryStatus(ps.ByName("id"))
+	if err == redis.ErrDemoNotFound {
+		renderAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cp16net/hod-test-app/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// redisScanParams pick a page of keys, or of the items of a value
+type redisScanParams struct {
+	Cursor uint64
+	Match  string
+	Count  int64
+}
+
+// redisScan reads ?cursor=, ?match= and ?count= of the request
+func redisScan(r *http.Request) (redisScanParams, error) {
+	q := r.URL.Query()
+	p := redisScanParams{Match: q.Get("match"), Count: redis.DefaultCount}
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return p, errors.New("cursor must be a positive integer")
+		}
+		p.Cursor = n
+	}
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return p, errors.New("count must be a positive integer")
+		}
+		p.Count = redis.ClampCount(n)
+	}
+	return p, nil
+}
+
+// maxTTL is the longest time to live in seconds that still fits a
+// time.Duration
+const maxTTL = int64(math.MaxInt64 / time.Second)
+
+// parseTTL reads a time to live in whole seconds, where 0 or nothing means
+// the key does not expire unless one is required
+func parseTTL(v string, required bool) (time.Duration, error) {
+	if v == "" && !required {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.New("ttl must be a positive number of seconds")
+	}
+	return ttlSeconds(n, required)
+}
+
+// ttlSeconds turns a time to live in seconds into a duration, refusing the
+// ones that are negative, zero when one is required, or would overflow
+func ttlSeconds(n int64, required bool) (time.Duration, error) {
+	if n < 0 || (required && n == 0) {
+		return 0, errors.New("ttl must be a positive number of seconds")
+	}
+	if n > maxTTL {
+		return 0, fmt.Errorf("ttl cannot be more than %d seconds", maxTTL)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// redisKeysURL links to the page of keys at the cursor
+func redisKeysURL(match string, cursor uint64, count int64) string {
+	q := url.Values{}
+	if match != "" {
+		q.Set("match", match)
+	}
+	if cursor != 0 {
+		q.Set("cursor", strconv.FormatUint(cursor, 10))
+	}
+	q.Set("count", strconv.FormatInt(count, 10))
+	return "/redis?" + q.Encode()
+}
+
+// redisKeyURL links to the page of the value of a key at the cursor
+func redisKeyURL(key string, cursor uint64, count int64) string {
+	q := url.Values{}
+	q.Set("key", key)
+	if cursor != 0 {
+		q.Set("cursor", strconv.FormatUint(cursor, 10))
+	}
+	q.Set("count", strconv.FormatInt(count, 10))
+	return "/redis/key?" + q.Encode()
+}
+
+// RedisKeyData for the page of a single key
+type RedisKeyData struct {
+	Key   string
+	Value redis.KeyValue
+	Count int64
+	Error string
+}
+
+// redisKeyHandler shows a key by ?key= since keys can hold slashes
+func redisKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := RedisKeyData{Key: r.URL.Query().Get("key")}
+	scan, err := redisScan(r)
+	data.Count = scan.Count
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/rediskey.html", data)
+		return
+	}
+	data.Value, err = redis.ReadKey(data.Key, scan.Cursor, scan.Count)
+	if err == redis.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		data.Error = fmt.Sprintf("key %q not found", data.Key)
+		renderTemplate(w, "templates/rediskey.html", data)
+		return
+	}
+	if err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	renderTemplate(w, "templates/rediskey.html", data)
+}
+
+func redisDeleteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := r.PostFormValue("key")
+	err := redis.Delete(key)
+	if err == redis.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		renderTemplate(w, "templates/rediskey.html", RedisKeyData{Key: key, Error: fmt.Sprintf("key %q not found", key)})
+		return
+	}
+	if err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	http.Redirect(w, r, "/redis", http.StatusFound)
+}
+
+// redisKeyAction runs an action on the key of the form and goes back to the
+// key page
+func redisKeyAction(w http.ResponseWriter, r *http.Request, action func(key string) error) {
+	key := r.PostFormValue("key")
+	err := action(key)
+	if err == redis.ErrKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		renderTemplate(w, "templates/rediskey.html", RedisKeyData{Key: key, Error: fmt.Sprintf("key %q not found", key)})
+		return
+	}
+	if err != nil {
+		renderUnavailable(w, "Redis", err)
+		return
+	}
+	http.Redirect(w, r, redisKeyURL(key, 0, redis.DefaultCount), http.StatusFound)
+}
+
+func redisExpireHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ttl, err := parseTTL(r.PostFormValue("ttl"), true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "templates/rediskey.html", RedisKeyData{Key: r.PostFormValue("key"), Error: err.Error()})
+		return
+	}
+	redisKeyAction(w, r, func(key string) error {
+		return redis.Expire(key, ttl)
+	})
+}
+
+func redisPersistHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	redisKeyAction(w, r, redis.Persist)
+}
+
+// APIRedisTTL is the time to live of a key in seconds, -1 when it does not
+// expire
+type APIRedisTTL struct {
+	Key string `json:"key"`
+	TTL int64  `json:"ttl"`
+}
+
+// apiRedisExpireHandler sets the ttl of an existing key
+func apiRedisExpireHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APIRedisTTL{}
+	if err := decodeJSON(r, &body); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	body.Key = ps.ByName("key")
+	ttl, err := ttlSeconds(body.TTL, true)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = redis.Expire(body.Key, ttl)
+	if err == redis.ErrKeyNotFound {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("key %q not found", body.Key))
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, body)
+}
+
+// apiRedisPersistHandler makes the key stop expiring
+func apiRedisPersistHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	err := redis.Persist(key)
+	if err == redis.ErrKeyNotFound {
+		renderAPIError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, APIRedisTTL{Key: key, TTL: -1})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sessionCookie is the name of the signed session cookie
+const sessionCookie = "session"
+
+// Session is the logged in user, carried in a signed cookie
+type Session struct {
+	Backend  string    `json:"backend"`
+	UserID   uint      `json:"user_id"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+	// Stamp is derived from the password hash the user had at login, a new
+	// password ends the sessions made with the old one
+	Stamp string `json:"stamp"`
+}
+
+var (
+	errBadSession     = errors.New("invalid session")
+	errSessionExpired = errors.New("session expired")
+	errSessionRevoked = errors.New("session revoked")
+)
+
+// sessionContextKey holds the session requireLogin checked on the request
+type sessionContextKey struct{}
+
+// sessionKey signs the session cookies, it comes from SESSION_SECRET or is
+// made up at startup, which logs everybody out on restart and only lets a
+// login work on the instance that made it
+var sessionKey []byte
+
+func setupSessions() {
+	if AppConfig.SessionSecret != "" {
+		sessionKey = []byte(AppConfig.SessionSecret)
+		return
+	}
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		common.Logger.Panic("could not create a session key: ", err)
+	}
+	common.Logger.Warn("SESSION_SECRET is not set, sessions will not survive a restart and only work on this instance")
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeSession renders the session as payload.signature
+func encodeSession(s Session) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + sign(payload), nil
+}
+
+// decodeSession checks the signature and expiry of a cookie value
+func decodeSession(value string) (Session, error) {
+	s := Session{}
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(sign(parts[0])), []byte(parts[1])) {
+		return s, errBadSession
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return s, errBadSession
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, errBadSession
+	}
+	if time.Now().After(s.Expires) {
+		return s, errSessionExpired
+	}
+	return s, nil
+}
+
+// sessionStamp of the password hash of the user
+func sessionStamp(user models.User) string {
+	return sign("password:" + user.Password)[:16]
+}
+
+// checkSession looks the user of the session up, sessions of users that
+// are deleted, purged or changed their password since are revoked
+func checkSession(s Session) error {
+	backend, ok := sqlBackends[s.Backend]
+	if !ok {
+		return errBadSession
+	}
+	user, err := backend.User(s.UserID)
+	if err == models.ErrUserNotFound {
+		return errSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if user.DeletedAt != nil || !hmac.Equal([]byte(sessionStamp(user)), []byte(s.Stamp)) {
+		return errSessionRevoked
+	}
+	return nil
+}
+
+// loadSession decodes and checks the session cookie of the request
+func loadSession(r *http.Request) (Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, err
+	}
+	s, err := decodeSession(c.Value)
+	if err != nil {
+		return s, err
+	}
+	return s, checkSession(s)
+}
+
+// loginRequired reports whether the error of loadSession means there is no
+// valid session, rather than that its user could not be looked up
+func loginRequired(err error) bool {
+	switch err {
+	case http.ErrNoCookie, errBadSession, errSessionExpired, errSessionRevoked:
+		return true
+	}
+	return false
+}
+
+// currentSession returns the session of the request, if it has a valid one
+func currentSession(r *http.Request) (Session, bool) {
+	if s, ok := r.Context().Value(sessionContextKey{}).(Session); ok {
+		return s, true
+	}
+	s, err := loadSession(r)
+	return s, err == nil
+}
+
+// withSession keeps the checked session on the request for the handlers
+// and wrappers after requireLogin
+func withSession(r *http.Request, s Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, s))
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// startSession sets the session cookie for the user
+func startSession(w http.ResponseWriter, r *http.Request, backend string, user models.User) (Session, error) {
+	s := Session{
+		Backend:  backend,
+		UserID:   user.ID,
+		Username: user.Username,
+		Expires:  time.Now().Add(AppConfig.SessionTTL),
+		Stamp:    sessionStamp(user),
+	}
+	value, err := encodeSession(s)
+	if err != nil {
+		return s, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return s, nil
+}
+
+func endSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requireLogin sends visitors without a session to the login page
+func requireLogin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		s, err := loadSession(r)
+		if err != nil && !loginRequired(err) {
+			renderUnavailable(w, "SQL", err)
+			return
+		}
+		if err != nil {
+			next := r.URL.RequestURI()
+			if r.Method != "GET" {
+				// a form post cannot be replayed, go back to the page it came from
+				next = "/"
+				if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+					next = ref.RequestURI()
+				}
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusFound)
+			return
+		}
+		h(w, withSession(r, s), ps)
+	}
+}
+
+// requireAPILogin answers 401 to api calls without a session
+func requireAPILogin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		s, err := loadSession(r)
+		if err != nil && !loginRequired(err) {
+			renderAPIError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			renderAPIError(w, http.StatusUnauthorized, errors.New("login required"))
+			return
+		}
+		h(w, withSession(r, s), ps)
+	}
+}
+
+// safeNext only allows redirects to paths on this site
+func safeNext(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || next == "" || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(next, "//") {
+		return "/"
+	}
+	return u.RequestURI()
+}
+
+// LoginData for the login and signup page
+type LoginData struct {
+	Backends []string
+	Backend  string
+	Login    string
+	Email    string
+	Next     string
+	Error    string
+	Session  *Session
+	// Signup is whether new accounts can be made
+	Signup bool
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, status int, data LoginData) {
+	data.Backends = sqlBackendNames
+	data.Signup = AppConfig.AllowSignup
+	if data.Backend == "" {
+		data.Backend = sqlBackendNames[0]
+	}
+	if s, ok := currentSession(r); ok {
+		data.Session = &s
+	}
+	w.WriteHeader(status)
+	renderTemplate(w, "templates/login.html", data)
+}
+
+func loginPageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	renderLogin(w, r, http.StatusOK, LoginData{Next: safeNext(r.URL.Query().Get("next"))})
+}
+
+// authenticate checks the login against the chosen backend
+func authenticate(backendName, login, password string) (models.User, error) {
+	backend, ok := sqlBackends[backendName]
+	if !ok {
+		return models.User{}, errors.New("unknown sql backend " + backendName)
+	}
+	return backend.Authenticate(login, password)
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := LoginData{
+		Backend: r.PostFormValue("backend"),
+		Login:   r.PostFormValue("login"),
+		Next:    safeNext(r.PostFormValue("next")),
+	}
+	user, err := authenticate(data.Backend, data.Login, r.PostFormValue("password"))
+	if err != nil {
+		status := http.StatusUnauthorized
+		if err != models.ErrInvalidLogin {
+			common.Logger.Error(err)
+			status = http.StatusServiceUnavailable
+		}
+		data.Error = err.Error()
+		renderLogin(w, r, status, data)
+		return
+	}
+	if _, err := startSession(w, r, data.Backend, user); err != nil {
+		renderUnavailable(w, "Sessions", err)
+		return
+	}
+	http.Redirect(w, r, data.Next, http.StatusFound)
+}
+
+func signupHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := LoginData{
+		Backend: r.PostFormValue("backend"),
+		Login:   r.PostFormValue("username"),
+		Email:   r.PostFormValue("email"),
+		Next:    safeNext(r.PostFormValue("next")),
+	}
+	if !AppConfig.AllowSignup {
+		data.Error = "signing up is closed"
+		renderLogin(w, r, http.StatusForbidden, data)
+		return
+	}
+	backend, ok := sqlBackends[data.Backend]
+	if !ok {
+		data.Error = "unknown sql backend " + data.Backend
+		renderLogin(w, r, http.StatusBadRequest, data)
+		return
+	}
+	user, err := models.NewUser(data.Login, data.Email, r.PostFormValue("password"))
+	if err == nil {
+		user, err = backend.CreateUser(user)
+	}
+	if err != nil {
+		data.Error = err.Error()
+		renderLogin(w, r, http.StatusBadRequest, data)
+		return
+	}
+	if _, err := startSession(w, r, data.Backend, user); err != nil {
+		renderUnavailable(w, "Sessions", err)
+		return
+	}
+	http.Redirect(w, r, data.Next, http.StatusFound)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	endSession(w, r)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// APILogin is the body of an api login
+type APILogin struct {
+	Backend  string `json:"backend"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+func apiLoginHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body := APILogin{}
+	if err := decodeJSON(r, &body); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Backend == "" {
+		body.Backend = sqlBackendNames[0]
+	}
+	user, err := authenticate(body.Backend, body.Login, body.Password)
+	if err == models.ErrInvalidLogin {
+		renderAPIError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		renderAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	s, err := startSession(w, r, body.Backend, user)
+	if err != nil {
+		renderAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	renderJSON(w, http.StatusOK, s)
+}
+
+func apiLogoutHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	endSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiSessionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s, ok := currentSession(r)
+	if !ok {
+		renderAPIError(w, http.StatusUnauthorized, errors.New("not logged in"))
+		return
+	}
+	renderJSON(w, http.StatusOK, s)
+}
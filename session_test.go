@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/sqlite"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionRevoked(t *testing.T) {
+	defer func(backends map[string]store.UserStore, ttl time.Duration) {
+		sqlBackends, AppConfig.SessionTTL = backends, ttl
+	}(sqlBackends, AppConfig.SessionTTL)
+	sqlite.Path = ":memory:"
+	models.PasswordCost = bcrypt.MinCost
+	sqlBackends = map[string]store.UserStore{"sqlite": sqlite.Store}
+	AppConfig.SessionTTL = time.Hour
+
+	login := func(username string) (models.User, *http.Cookie) {
+		user, err := models.NewUser(username, username+"@session.test", "secret")
+		if err == nil {
+			user, err = sqlite.Store.CreateUser(user)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if _, err := startSession(w, httptest.NewRequest("POST", "/login", nil), "sqlite", user); err != nil {
+			t.Fatal(err)
+		}
+		return user, w.Result().Cookies()[0]
+	}
+	status := func(c *http.Cookie) int {
+		h := requireAPILogin(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		r := httptest.NewRequest("GET", "/api/v1/session", nil)
+		r.AddCookie(c)
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w.Code
+	}
+
+	ann, annCookie := login("ann")
+	if got := status(annCookie); got != http.StatusNoContent {
+		t.Fatalf("a fresh session: got %d", got)
+	}
+	password := "changed"
+	if _, err := sqlite.Store.UpdateUser(ann.ID, models.UserUpdate{Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(annCookie); got != http.StatusUnauthorized {
+		t.Errorf("after a password change: got %d, want 401", got)
+	}
+
+	bob, bobCookie := login("bob")
+	if err := sqlite.Store.DeleteUser(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(bobCookie); got != http.StatusUnauthorized {
+		t.Errorf("after a delete: got %d, want 401", got)
+	}
+	if err := sqlite.Store.PurgeUser(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(bobCookie); got != http.StatusUnauthorized {
+		t.Errorf("after a purge: got %d, want 401", got)
+	}
+}
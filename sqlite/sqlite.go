@@ -0,0 +1,38 @@
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/cp16net/hod-test-app/migrations"
+	"github.com/cp16net/hod-test-app/store"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // needed for gorm
+)
+
+// Path of the database file, ":memory:" keeps it in memory for the life of
+// the process
+var Path = "hod-test-app.db"
+
+// dsn of the database at Path. Writes wait for each other instead of
+// failing while the file is locked.
+func dsn() (string, error) {
+	switch Path {
+	case "":
+		return "", errors.New("no sqlite path set")
+	case ":memory:":
+		return "file::memory:?cache=shared&_busy_timeout=5000", nil
+	}
+	return "file:" + Path + "?_busy_timeout=5000&_journal_mode=WAL", nil
+}
+
+// Store is the local sqlite database, for running the sql pages without a
+// database service
+var Store = store.New(store.Dialect{
+	Name:       "sqlite",
+	Gorm:       "sqlite3",
+	Migrations: migrations.SQLite,
+	DSN:        dsn,
+	// sqlite has one writer at a time, a single connection queues the
+	// writes instead of failing them
+	MaxOpenConns: 1,
+})
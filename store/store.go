@@ -0,0 +1,460 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cp16net/hod-test-app/audit"
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/migrations"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/outbox"
+	"github.com/jinzhu/gorm"
+)
+
+// UserStore is what the app does with the users of a sql database
+type UserStore interface {
+	Ready() error
+	Ping() error
+	Migrator() (*migrations.Migrator, error)
+	CreateUser(user models.User) (models.User, error)
+	CreateUserWithOutbox(user models.User, targets []string) (models.User, error)
+	CopyUser(user models.User) (models.User, error)
+	Authenticate(email, password string) (models.User, error)
+	ListUsers(opts models.ListOptions) (models.UserPage, error)
+	EachUser(opts models.ListOptions, fn func(models.User) error) error
+	UpsertUser(user models.User, opts models.Upsert) (created bool, err error)
+	AllUsers(limit int) ([]models.User, error)
+	User(id uint) (models.User, error)
+	UserByEmail(email string) (models.User, error)
+	UpdateUser(id uint, update models.UserUpdate) (models.User, error)
+	DeleteUser(id uint) error
+	RestoreUser(id uint) error
+	PurgeUser(id uint) error
+	Outbox() (*outbox.Store, error)
+	Audit() (*audit.Store, error)
+}
+
+// Dialect is what differs between the databases a Store can use
+type Dialect struct {
+	// Name of the backend in logs, metrics and errors
+	Name string
+	// Gorm is the gorm dialect, which also names the database/sql driver
+	Gorm string
+	// Migrations is the dialect the schema migrations are written for
+	Migrations string
+	// DSN builds the connection string, usually from the bound service
+	DSN func() (string, error)
+	// MaxOpenConns overrides common.PoolSize when it is set
+	MaxOpenConns int
+}
+
+// Store keeps the users in one sql database through gorm
+type Store struct {
+	dialect Dialect
+	setup   *common.Lazy
+	// db is the pooled connection shared by every request
+	db *gorm.DB
+}
+
+var _ UserStore = (*Store)(nil)
+
+// New creates the store of a dialect, it connects on first use
+func New(dialect Dialect) *Store {
+	s := &Store{dialect: dialect}
+	// open the pool and migrate the schema the first time the database is
+	// used
+	s.setup = common.NewLazy(dialect.Name, func() error {
+		conn, err := s.connect()
+		if err != nil {
+			return err
+		}
+		maxOpen := common.PoolSize
+		if dialect.MaxOpenConns > 0 {
+			maxOpen = dialect.MaxOpenConns
+		}
+		conn.DB().SetMaxOpenConns(maxOpen)
+		conn.DB().SetMaxIdleConns(common.PoolIdle)
+
+		if err := migrations.Prepare(conn.DB(), dialect.Migrations); err != nil {
+			conn.Close()
+			return err
+		}
+		s.db = conn
+		return nil
+	})
+	return s
+}
+
+// Name of the backend
+func (s *Store) Name() string {
+	return s.dialect.Name
+}
+
+func (s *Store) connect() (*gorm.DB, error) {
+	common.Logger.Debugf("connecting to %s", s.dialect.Name)
+	dsn, err := s.dialect.DSN()
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(s.dialect.Gorm, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %s", err)
+	}
+	db.LogMode(true)
+	return db, nil
+}
+
+// Migrator connects a migrator for the migrate command, without running
+// the migrations the way the first use of the store does
+func (s *Store) Migrator() (*migrations.Migrator, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return migrations.New(conn.DB(), s.dialect.Migrations)
+}
+
+// Ready initializes the database if needed and returns why it is
+// unavailable
+func (s *Store) Ready() error {
+	return s.setup.Ready()
+}
+
+// Ping checks that the database answers on the shared pool
+func (s *Store) Ping() error {
+	if err := s.Ready(); err != nil {
+		return err
+	}
+	return s.db.DB().Ping()
+}
+
+// CreateUser stores a user built with models.NewUser
+func (s *Store) CreateUser(user models.User) (created models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "CreateUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	err = s.db.Create(&user).Error
+	return user, err
+}
+
+// CreateUserWithOutbox stores the user and, in the same transaction, an
+// outbox entry for each target database it still has to be copied to
+func (s *Store) CreateUserWithOutbox(user models.User, targets []string) (created models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "CreateUserWithOutbox", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	tx := s.db.Begin()
+	if err := tx.Create(&user).Error; err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	if err := outbox.Enqueue(tx, user, targets); err != nil {
+		tx.Rollback()
+		return user, err
+	}
+	return user, tx.Commit().Error
+}
+
+// CopyUser stores a user read from another database, keeping its password
+// hash and timestamps but not its id
+func (s *Store) CopyUser(user models.User) (copied models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "CopyUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	copied = models.User{Username: user.Username, Email: user.Email, Password: user.Password}
+	tx := s.db.Begin()
+	if err := tx.Create(&copied).Error; err != nil {
+		tx.Rollback()
+		return copied, err
+	}
+	// create always stamps the current time, put the original times back
+	err = tx.Unscoped().Model(&copied).UpdateColumns(map[string]interface{}{
+		"created_at": user.CreatedAt,
+		"updated_at": user.UpdatedAt,
+		"deleted_at": user.DeletedAt,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return copied, err
+	}
+	copied.CreatedAt, copied.UpdatedAt, copied.DeletedAt = user.CreatedAt, user.UpdatedAt, user.DeletedAt
+	return copied, tx.Commit().Error
+}
+
+// Authenticate finds the live user with the email and checks the password.
+// Usernames are not unique, so they cannot name the account to log in to.
+func (s *Store) Authenticate(email, password string) (user models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "Authenticate", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	q := s.db.Where("email = ?", strings.TrimSpace(email)).First(&user)
+	if q.RecordNotFound() {
+		return user, models.ErrInvalidLogin
+	}
+	if q.Error != nil {
+		return user, q.Error
+	}
+	if !user.CheckPassword(password) {
+		return models.User{}, models.ErrInvalidLogin
+	}
+	return user, nil
+}
+
+// ListUsers returns one page of the users matching the filters of opts,
+// live, soft deleted or both
+func (s *Store) ListUsers(opts models.ListOptions) (page models.UserPage, err error) {
+	defer common.ObserveCall(s.dialect.Name, "ListUsers", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return page, err
+	}
+	opts = opts.Normalize()
+	if err := opts.Validate(); err != nil {
+		return page, err
+	}
+	q := s.filtered(opts)
+	var total int
+	if err := q.Count(&total).Error; err != nil {
+		return page, err
+	}
+	users := []models.User{}
+	if err := q.Order(opts.OrderBy()).Offset(opts.Offset()).Limit(opts.PerPage).Find(&users).Error; err != nil {
+		return page, err
+	}
+	common.Logger.Debugf("found %d users", len(users))
+	return models.NewUserPage(opts, total, users), nil
+}
+
+// filtered selects the users matching the filters of opts, live, soft
+// deleted or both
+func (s *Store) filtered(opts models.ListOptions) *gorm.DB {
+	q := s.db.Model(&models.User{})
+	switch {
+	case opts.Deleted:
+		q = q.Unscoped().Where("deleted_at IS NOT NULL")
+	case opts.IncludeDeleted:
+		q = q.Unscoped()
+	}
+	if where, args := opts.Where(); where != "" {
+		q = q.Where(where, args...)
+	}
+	return q
+}
+
+// EachUserBatch is how many users EachUser reads with each query
+var EachUserBatch = 500
+
+// EachUser calls fn with every user matching the filters of opts, in their
+// sort order, reading them from the database a batch at a time rather than
+// all at once. Paging is ignored. No query is left open while fn runs, so a
+// slow fn does not hold on to a connection; users written in the meantime
+// can shift between batches.
+func (s *Store) EachUser(opts models.ListOptions, fn func(models.User) error) (err error) {
+	defer common.ObserveCall(s.dialect.Name, "EachUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return err
+	}
+	opts = opts.Normalize()
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	q := s.filtered(opts).Order(opts.OrderBy())
+	if opts.Sort != "id" {
+		// ties have to come back in the same order in every batch
+		q = q.Order("id asc")
+	}
+	for offset := 0; ; offset += EachUserBatch {
+		users := []models.User{}
+		if err := q.Offset(offset).Limit(EachUserBatch).Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < EachUserBatch {
+			return nil
+		}
+	}
+}
+
+// UpsertUser stores an imported user, updating the user with the same
+// email if there is one. The timestamps of the import are kept when they
+// are set, the stored password and deletion only change when opts says so.
+func (s *Store) UpsertUser(user models.User, opts models.Upsert) (created bool, err error) {
+	defer common.ObserveCall(s.dialect.Name, "UpsertUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return false, err
+	}
+	tx := s.db.Begin()
+	existing := models.User{}
+	q := tx.Unscoped().Where("email = ?", user.Email).First(&existing)
+	if q.Error != nil && !q.RecordNotFound() {
+		tx.Rollback()
+		return false, q.Error
+	}
+	fields := map[string]interface{}{}
+	if !user.CreatedAt.IsZero() {
+		fields["created_at"] = user.CreatedAt
+	}
+	fields["updated_at"] = time.Now()
+	if !user.UpdatedAt.IsZero() {
+		fields["updated_at"] = user.UpdatedAt
+	}
+	if q.RecordNotFound() {
+		if user.Password == "" {
+			tx.Rollback()
+			return false, errors.New("password is required for a new user")
+		}
+		existing = models.User{Username: user.Username, Email: user.Email, Password: user.Password}
+		if err := tx.Create(&existing).Error; err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		created = true
+		fields["deleted_at"] = user.DeletedAt
+	} else {
+		fields["username"] = user.Username
+		if opts.Password && user.Password != "" {
+			fields["password"] = user.Password
+		}
+		if opts.DeletedAt {
+			fields["deleted_at"] = user.DeletedAt
+		}
+	}
+	if err := tx.Unscoped().Model(&existing).UpdateColumns(fields).Error; err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return created, tx.Commit().Error
+}
+
+// ErrTooManyUsers is returned by AllUsers when there are more users than
+// it may load
+var ErrTooManyUsers = errors.New("too many users to load at once")
+
+// AllUsers returns every user, soft deleted ones included, ordered by email.
+// It fails with ErrTooManyUsers instead of loading more than limit users.
+func (s *Store) AllUsers(limit int) (users []models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "AllUsers", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return nil, err
+	}
+	err = s.db.Unscoped().Order("email asc").Limit(limit + 1).Find(&users).Error
+	if err == nil && len(users) > limit {
+		return nil, ErrTooManyUsers
+	}
+	return users, err
+}
+
+// User returns a single user, soft deleted users included
+func (s *Store) User(id uint) (user models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "User", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	q := s.db.Unscoped().First(&user, id)
+	if q.RecordNotFound() {
+		return user, models.ErrUserNotFound
+	}
+	return user, q.Error
+}
+
+// UserByEmail returns the user with the email, soft deleted users included
+func (s *Store) UserByEmail(email string) (user models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "UserByEmail", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	q := s.db.Unscoped().Where("email = ?", email).First(&user)
+	if q.RecordNotFound() {
+		return user, models.ErrUserNotFound
+	}
+	return user, q.Error
+}
+
+// UpdateUser changes the fields set in update on a live user
+func (s *Store) UpdateUser(id uint, update models.UserUpdate) (user models.User, err error) {
+	defer common.ObserveCall(s.dialect.Name, "UpdateUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return user, err
+	}
+	if err := update.Validate(); err != nil {
+		return user, err
+	}
+	q := s.db.First(&user, id)
+	if q.RecordNotFound() {
+		return user, models.ErrUserNotFound
+	}
+	if q.Error != nil {
+		return user, q.Error
+	}
+	fields, err := update.Fields()
+	if err != nil {
+		return user, err
+	}
+	err = s.db.Model(&user).Updates(fields).Error
+	return user, err
+}
+
+// DeleteUser soft deletes a user, it can be brought back with RestoreUser
+func (s *Store) DeleteUser(id uint) (err error) {
+	defer common.ObserveCall(s.dialect.Name, "DeleteUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return err
+	}
+	q := s.db.Where("id = ?", id).Delete(&models.User{})
+	if q.Error == nil && q.RowsAffected == 0 {
+		return models.ErrUserNotFound
+	}
+	return q.Error
+}
+
+// RestoreUser undoes the soft delete of a user
+func (s *Store) RestoreUser(id uint) (err error) {
+	defer common.ObserveCall(s.dialect.Name, "RestoreUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return err
+	}
+	q := s.db.Unscoped().Model(&models.User{}).Where("id = ? AND deleted_at IS NOT NULL", id).UpdateColumn("deleted_at", nil)
+	if q.Error == nil && q.RowsAffected == 0 {
+		return models.ErrUserNotFound
+	}
+	return q.Error
+}
+
+// PurgeUser removes a user for good, whether or not it was soft deleted
+func (s *Store) PurgeUser(id uint) (err error) {
+	defer common.ObserveCall(s.dialect.Name, "PurgeUser", time.Now(), &err)
+	if err := s.Ready(); err != nil {
+		return err
+	}
+	q := s.db.Unscoped().Where("id = ?", id).Delete(&models.User{})
+	if q.Error == nil && q.RowsAffected == 0 {
+		return models.ErrUserNotFound
+	}
+	return q.Error
+}
+
+// Outbox is the outbox kept in this database
+func (s *Store) Outbox() (*outbox.Store, error) {
+	if err := s.Ready(); err != nil {
+		return nil, err
+	}
+	return outbox.NewStore(s.db), nil
+}
+
+// Audit is the audit log kept in this database
+func (s *Store) Audit() (*audit.Store, error) {
+	if err := s.Ready(); err != nil {
+		return nil, err
+	}
+	return audit.NewStore(s.db), nil
+}
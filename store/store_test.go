@@ -0,0 +1,321 @@
+package store_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/sqlite"
+	"github.com/cp16net/hod-test-app/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the tests share one in-memory sqlite database, each test keeps to users
+// of its own email domain
+var db = sqlite.Store
+
+func TestMain(m *testing.M) {
+	sqlite.Path = ":memory:"
+	models.PasswordCost = bcrypt.MinCost
+	if err := db.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, "sqlite:", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func createUser(t *testing.T, username, email string) models.User {
+	user, err := models.NewUser(username, email, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.CreateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestCRUD(t *testing.T) {
+	created := createUser(t, "ann", "ann@crud.test")
+	if created.ID == 0 {
+		t.Fatal("created user has no id")
+	}
+	if user, err := db.User(created.ID); err != nil || user.Email != "ann@crud.test" {
+		t.Errorf("User: got %+v, %v", user, err)
+	}
+	if user, err := db.UserByEmail("ann@crud.test"); err != nil || user.ID != created.ID {
+		t.Errorf("UserByEmail: got %+v, %v", user, err)
+	}
+	if _, err := db.Authenticate(" ann@crud.test", "secret"); err != nil {
+		t.Errorf("Authenticate: %s", err)
+	}
+	if _, err := db.Authenticate("ann", "secret"); err != models.ErrInvalidLogin {
+		t.Errorf("Authenticate with a username: got %v", err)
+	}
+	if _, err := db.Authenticate("ann@crud.test", "wrong"); err != models.ErrInvalidLogin {
+		t.Errorf("Authenticate with a wrong password: got %v", err)
+	}
+
+	name := " annie "
+	updated, err := db.UpdateUser(created.ID, models.UserUpdate{Username: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Username != "annie" {
+		t.Errorf("UpdateUser: username %q", updated.Username)
+	}
+	if _, err := db.Authenticate("ann@crud.test", "secret"); err != nil {
+		t.Errorf("Authenticate after the update: %s", err)
+	}
+	if _, err := db.UpdateUser(created.ID, models.UserUpdate{}); err == nil {
+		t.Error("UpdateUser with nothing to update: expected an error")
+	}
+
+	if _, err := db.User(created.ID + 1000); err != models.ErrUserNotFound {
+		t.Errorf("User of an unknown id: got %v", err)
+	}
+	if _, err := db.CreateUser(models.User{Username: "dup", Email: "ann@crud.test", Password: "x"}); err == nil {
+		t.Error("CreateUser with a taken email: expected an error")
+	}
+}
+
+func TestSoftDeleteRestorePurge(t *testing.T) {
+	user := createUser(t, "bob", "bob@delete.test")
+
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteUser(user.ID); err != models.ErrUserNotFound {
+		t.Errorf("DeleteUser twice: got %v", err)
+	}
+	if _, err := db.Authenticate("bob@delete.test", "secret"); err != models.ErrInvalidLogin {
+		t.Errorf("Authenticate a deleted user: got %v", err)
+	}
+	deleted, err := db.User(user.ID)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Errorf("User of a deleted user: got %+v, %v", deleted, err)
+	}
+	if _, err := db.UpdateUser(user.ID, models.UserUpdate{Username: &user.Username}); err != models.ErrUserNotFound {
+		t.Errorf("UpdateUser of a deleted user: got %v", err)
+	}
+	live, _ := db.ListUsers(models.ListOptions{Email: "@delete.test"})
+	gone, _ := db.ListUsers(models.ListOptions{Email: "@delete.test", Deleted: true})
+	if live.Total != 0 || gone.Total != 1 {
+		t.Errorf("listed %d live and %d deleted users, want 0 and 1", live.Total, gone.Total)
+	}
+
+	if err := db.RestoreUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreUser(user.ID); err != models.ErrUserNotFound {
+		t.Errorf("RestoreUser of a live user: got %v", err)
+	}
+	if _, err := db.Authenticate("bob@delete.test", "secret"); err != nil {
+		t.Errorf("Authenticate a restored user: %s", err)
+	}
+
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	// a purge removes soft deleted users too
+	if err := db.PurgeUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.User(user.ID); err != models.ErrUserNotFound {
+		t.Errorf("User of a purged user: got %v", err)
+	}
+	if err := db.PurgeUser(user.ID); err != models.ErrUserNotFound {
+		t.Errorf("PurgeUser twice: got %v", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	a := createUser(t, "Carol", "carol_1@list.test")
+	b := createUser(t, "carl", "carolx1@list.test")
+	c := createUser(t, "dave", "dave@list.test")
+	if err := db.DeleteUser(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name string
+		opts models.ListOptions
+		want []uint
+	}{
+		{"live", models.ListOptions{Email: "@list.test"}, []uint{a.ID, b.ID}},
+		{"deleted", models.ListOptions{Email: "@list.test", Deleted: true}, []uint{c.ID}},
+		{"include deleted", models.ListOptions{Email: "@list.test", IncludeDeleted: true}, []uint{a.ID, b.ID, c.ID}},
+		{"username ignores case", models.ListOptions{Email: "@list.test", Username: "CAR"}, []uint{a.ID, b.ID}},
+		{"underscore is no wildcard", models.ListOptions{Email: "carol_1"}, []uint{a.ID}},
+		{"sorted", models.ListOptions{Email: "@list.test", Sort: "username", Desc: true}, []uint{b.ID, a.ID}},
+		{"created after", models.ListOptions{Email: "@list.test", CreatedAfter: &future}, nil},
+		{"created before", models.ListOptions{Email: "@list.test", CreatedBefore: &future}, []uint{a.ID, b.ID}},
+	}
+	for _, tt := range tests {
+		page, err := db.ListUsers(tt.opts)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got []uint
+		for _, user := range page.Users {
+			got = append(got, user.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || page.Total != len(tt.want) {
+			t.Errorf("%s: got %v of %d, want %v", tt.name, got, page.Total, tt.want)
+		}
+	}
+
+	page, err := db.ListUsers(models.ListOptions{Email: "@list.test", IncludeDeleted: true, PerPage: 2, Page: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.Pages != 2 || len(page.Users) != 1 || page.Users[0].ID != c.ID {
+		t.Errorf("second page: got %d users of %d in %d pages", len(page.Users), page.Total, page.Pages)
+	}
+	if _, err := db.ListUsers(models.ListOptions{Sort: "password"}); err == nil {
+		t.Error("sorting by password: expected an error")
+	}
+}
+
+func TestUpsertUser(t *testing.T) {
+	if _, err := db.UpsertUser(models.User{Username: "erin", Email: "erin@upsert.test"}, models.Upsert{}); err == nil {
+		t.Error("UpsertUser of a new user without a password: expected an error")
+	}
+
+	imported, err := models.NewUser("erin", "erin@upsert.test", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported.CreatedAt = time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	created, err := db.UpsertUser(imported, models.Upsert{})
+	if err != nil || !created {
+		t.Fatalf("UpsertUser of a new user: got %v, %v", created, err)
+	}
+	user, err := db.UserByEmail("erin@upsert.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.CreatedAt.Equal(imported.CreatedAt) {
+		t.Errorf("created at: got %s, want %s", user.CreatedAt, imported.CreatedAt)
+	}
+
+	// the password and deletion of an existing user are kept unless the
+	// upsert says otherwise
+	other, _ := models.NewUser("erin2", "erin@upsert.test", "other")
+	deletedAt := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	other.DeletedAt = &deletedAt
+	created, err = db.UpsertUser(other, models.Upsert{})
+	if err != nil || created {
+		t.Fatalf("UpsertUser of an existing user: got %v, %v", created, err)
+	}
+	user, err = db.User(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "erin2" || user.DeletedAt != nil || !user.CheckPassword("secret") {
+		t.Errorf("updated user: got %+v", user)
+	}
+
+	if _, err := db.UpsertUser(other, models.Upsert{Password: true, DeletedAt: true}); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = db.User(user.ID)
+	if user.DeletedAt == nil || !user.CheckPassword("other") {
+		t.Errorf("password and deletion not replaced: got %+v", user)
+	}
+
+	// a file without deleted_at does not restore the user
+	other.DeletedAt = nil
+	if _, err := db.UpsertUser(other, models.Upsert{}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ = db.User(user.ID); user.DeletedAt == nil {
+		t.Error("a deleted user was restored")
+	}
+}
+
+func TestCopyUser(t *testing.T) {
+	created := time.Date(2014, 6, 1, 8, 30, 0, 0, time.UTC)
+	deleted := time.Date(2015, 6, 1, 8, 30, 0, 0, time.UTC)
+	original := createUser(t, "fred", "fred@copy.test")
+	original.ID = 12345
+	original.Email = "fred2@copy.test"
+	original.CreatedAt, original.UpdatedAt, original.DeletedAt = created, created, &deleted
+
+	copied, err := db.CopyUser(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.ID == original.ID {
+		t.Error("the copy kept the id of the original")
+	}
+	stored, err := db.User(copied.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CreatedAt.Equal(created) || !stored.UpdatedAt.Equal(created) ||
+		stored.DeletedAt == nil || !stored.DeletedAt.Equal(deleted) {
+		t.Errorf("timestamps not kept: got %+v", stored)
+	}
+	if stored.Password != original.Password {
+		t.Error("password hash not kept")
+	}
+}
+
+func TestAllUsers(t *testing.T) {
+	createUser(t, "gina", "gina@all.test")
+	createUser(t, "hank", "hank@all.test")
+	users, err := db.AllUsers(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) < 2 {
+		t.Errorf("got %d users", len(users))
+	}
+	for i := 1; i < len(users); i++ {
+		if users[i-1].Email > users[i].Email {
+			t.Errorf("not ordered by email: %s before %s", users[i-1].Email, users[i].Email)
+		}
+	}
+	if _, err := db.AllUsers(1); err != store.ErrTooManyUsers {
+		t.Errorf("AllUsers over the limit: got %v", err)
+	}
+}
+
+func TestEachUser(t *testing.T) {
+	defer func(batch int) { store.EachUserBatch = batch }(store.EachUserBatch)
+	store.EachUserBatch = 2
+	var want []string
+	for _, name := range []string{"ivy", "ida", "ike", "ian", "ira"} {
+		createUser(t, "same", name+"@each.test")
+		want = append(want, name+"@each.test")
+	}
+	// every username is the same, the batches only line up when ties are
+	// broken by id
+	var got []string
+	err := db.EachUser(models.ListOptions{Email: "@each.test", Sort: "username", PerPage: 1, Page: 3}, func(user models.User) error {
+		got = append(got, user.Email)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = db.EachUser(models.ListOptions{Email: "@each.test"}, func(models.User) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("an error of fn: got %v after %d calls", err, calls)
+	}
+}
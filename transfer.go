@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/cp16net/hod-test-app/common"
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/cp16net/hod-test-app/userio"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxImportSize is the largest file an import reads
+const maxImportSize = 64 << 20
+
+// maxImportErrors is how many failed rows an import lists, the rest are
+// only counted
+const maxImportErrors = 1000
+
+// exportFlushEvery rows the export is sent on instead of buffered
+const exportFlushEvery = 100
+
+// exportUsers streams the users of the backend matching the listing
+// filters of the request. Every user is exported unless ?deleted= says
+// otherwise, without the password hashes unless passwords is set.
+func exportUsers(w http.ResponseWriter, r *http.Request, name string, passwords bool) error {
+	backend, ok := sqlBackends[name]
+	if !ok {
+		return fmt.Errorf("unknown sql backend %q", name)
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = userio.CSV
+	}
+	opts, err := listOptions(r)
+	if err != nil {
+		return err
+	}
+	if r.URL.Query().Get("deleted") == "" {
+		opts.IncludeDeleted = true
+	}
+	if err := backend.Ready(); err != nil {
+		return unavailable(name, err)
+	}
+	uw, err := userio.NewWriter(w, format)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", userio.ContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-users."+format))
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err = backend.EachUser(opts, func(user models.User) error {
+		if !passwords {
+			user.Password = ""
+		}
+		if err := uw.Write(user); err != nil {
+			return err
+		}
+		if n++; n%exportFlushEvery == 0 {
+			if err := uw.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// the status is sent already, all that is left is to cut the
+		// export short
+		common.Logger.Errorf("export of %s users failed after %d rows: %s", name, n, err)
+		return nil
+	}
+	if err := uw.Flush(); err != nil {
+		common.Logger.Errorf("export of %s users failed: %s", name, err)
+	}
+	return nil
+}
+
+// unavailable marks an error of a backend that is not ready so it is
+// answered with 503, not blamed on the request
+func unavailable(name string, err error) error {
+	if common.IsUnavailable(err) {
+		return err
+	}
+	return &common.UnavailableError{Backend: name, Err: err}
+}
+
+// ImportError is a row of an import that was not stored
+type ImportError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportResult counts what an import did with each row
+type ImportResult struct {
+	Backend string        `json:"backend"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors,omitempty"`
+	// Aborted is why the import stopped before the end of the file
+	Aborted string `json:"aborted,omitempty"`
+}
+
+// Imported is how many rows were stored
+func (r ImportResult) Imported() int {
+	return r.Created + r.Updated
+}
+
+func (r *ImportResult) fail(line int, email string, err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportError{Line: line, Email: email, Error: err.Error()})
+	}
+}
+
+// importUsers validates and upserts every row of the file, carrying on past
+// the rows that fail. The passwords of existing users are only replaced
+// when passwords is set.
+func importUsers(name string, backend store.UserStore, body io.Reader, format string, passwords bool) (ImportResult, error) {
+	result := ImportResult{Backend: name}
+	reader, err := userio.NewReader(body, format)
+	if err != nil {
+		return result, err
+	}
+	if err := backend.Ready(); err != nil {
+		return result, unavailable(name, err)
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Aborted = err.Error()
+			break
+		}
+		if row.Err != nil {
+			result.fail(row.Line, row.User.Email, row.Err)
+			continue
+		}
+		created, err := backend.UpsertUser(row.User, models.Upsert{Password: passwords, DeletedAt: row.HasDeletedAt})
+		if common.IsUnavailable(err) {
+			result.Aborted = err.Error()
+			break
+		}
+		switch {
+		case err != nil:
+			result.fail(row.Line, row.User.Email, err)
+		case created:
+			result.Created++
+		default:
+			result.Updated++
+		}
+	}
+	common.Logger.Infof("imported %d users into %s, %d rows failed", result.Imported(), name, result.Failed)
+	return result, nil
+}
+
+// formatOfFile picks the import format from the form, or else from the
+// extension of the uploaded file
+func formatOfFile(format, filename string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv":
+		return userio.CSV
+	case ".ndjson", ".jsonl", ".json":
+		return userio.NDJSON
+	}
+	return ""
+}
+
+// TransferData for the import and export page
+type TransferData struct {
+	Backends []string
+	Result   *ImportResult
+	Error    string
+}
+
+func transferHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	renderTemplate(w, "templates/transfer.html", TransferData{Backends: sqlBackendNames})
+}
+
+// passwordsRequest resolves whether an export or import may handle password
+// hashes, which needs the admin token
+func passwordsRequest(w http.ResponseWriter, r *http.Request, render func(int, error)) (passwords bool, ok bool) {
+	return revealRequest(w, r, "passwords", render)
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	passwords, ok := passwordsRequest(w, r, func(status int, err error) {
+		w.WriteHeader(status)
+		renderTemplate(w, "templates/transfer.html", TransferData{Backends: sqlBackendNames, Error: err.Error()})
+	})
+	if !ok {
+		return
+	}
+	if err := exportUsers(w, r, r.URL.Query().Get("backend"), passwords); err != nil {
+		if common.IsUnavailable(err) {
+			renderUnavailable(w, "SQL", err)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "templates/transfer.html", TransferData{Backends: sqlBackendNames, Error: err.Error()})
+	}
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	data := TransferData{Backends: sqlBackendNames}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	passwords, ok := passwordsRequest(w, r, func(status int, err error) {
+		w.WriteHeader(status)
+		data.Error = err.Error()
+		renderTemplate(w, "templates/transfer.html", data)
+	})
+	if !ok {
+		return
+	}
+	name := r.FormValue("backend")
+	backend, ok := sqlBackends[name]
+	if !ok {
+		data.Error = fmt.Sprintf("unknown sql backend %q", name)
+		renderTemplate(w, "templates/transfer.html", data)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		data.Error = "choose a file to import: " + err.Error()
+		renderTemplate(w, "templates/transfer.html", data)
+		return
+	}
+	defer file.Close()
+	result, err := importUsers(name, backend, file, formatOfFile(r.FormValue("format"), header.Filename), passwords)
+	if common.IsUnavailable(err) {
+		renderUnavailable(w, "SQL", err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+	} else {
+		data.Result = &result
+	}
+	renderTemplate(w, "templates/transfer.html", data)
+}
+
+// apiExportHandler streams the users as ?format=csv (the default) or
+// ndjson
+func apiExportHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if _, ok := lookupSQLBackend(w, ps); !ok {
+		return
+	}
+	passwords, ok := passwordsRequest(w, r, func(status int, err error) {
+		renderAPIError(w, status, err)
+	})
+	if !ok {
+		return
+	}
+	if err := exportUsers(w, r, ps.ByName("backend"), passwords); err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+	}
+}
+
+// apiImportHandler reads a csv or ndjson body, picked by ?format= or the
+// content type. It answers 200 when every row is stored, 207 when only
+// some are and 400 when none are.
+func apiImportHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, ok := lookupSQLBackend(w, ps)
+	if !ok {
+		return
+	}
+	passwords, ok := passwordsRequest(w, r, func(status int, err error) {
+		renderAPIError(w, status, err)
+	})
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = userio.FormatOf(r.Header.Get("Content-Type"))
+	}
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	result, err := importUsers(ps.ByName("backend"), backend, body, format, passwords)
+	if err != nil {
+		renderAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	status := http.StatusOK
+	switch {
+	case result.Failed == 0 && result.Aborted == "":
+	case result.Imported() > 0:
+		status = http.StatusMultiStatus
+	default:
+		status = http.StatusBadRequest
+	}
+	renderJSON(w, status, result)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/sqlite"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// downStore is a backend that cannot be reached
+type downStore struct {
+	store.UserStore
+}
+
+func (downStore) Ready() error {
+	return errors.New("connection refused")
+}
+
+func TestTransferUnavailableBackend(t *testing.T) {
+	defer func(backends map[string]store.UserStore) { sqlBackends = backends }(sqlBackends)
+	sqlBackends = map[string]store.UserStore{"down": downStore{}}
+	ps := httprouter.Params{{Key: "backend", Value: "down"}}
+
+	w := httptest.NewRecorder()
+	apiExportHandler(w, httptest.NewRequest("GET", "/api/v1/export/down", nil), ps)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("export: got %d, want 503", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	apiImportHandler(w, httptest.NewRequest("POST", "/api/v1/import/down?format=csv", nil), ps)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("import: got %d, want 503", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	apiExportHandler(w, httptest.NewRequest("GET", "/api/v1/export/down?sort=password", nil), ps)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("export with a bad sort: got %d, want 400", w.Code)
+	}
+}
+
+func TestExportPasswords(t *testing.T) {
+	defer func(backends map[string]store.UserStore, token string) {
+		sqlBackends, AppConfig.AdminToken = backends, token
+	}(sqlBackends, AppConfig.AdminToken)
+	sqlite.Path = ":memory:"
+	models.PasswordCost = bcrypt.MinCost
+	sqlBackends = map[string]store.UserStore{"sqlite": sqlite.Store}
+	user, _ := models.NewUser("pat", "pat@export.test", "secret")
+	if _, err := sqlite.Store.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	ps := httprouter.Params{{Key: "backend", Value: "sqlite"}}
+	export := func(query, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/export/sqlite?format=ndjson&email=@export.test"+query, nil)
+		if token != "" {
+			r.Header.Set("X-Admin-Token", token)
+		}
+		w := httptest.NewRecorder()
+		apiExportHandler(w, r, ps)
+		return w
+	}
+
+	AppConfig.AdminToken = ""
+	if w := export("", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "password") {
+		t.Errorf("a plain export: got %d %s", w.Code, w.Body)
+	}
+	if w := export("&passwords=true", ""); w.Code != http.StatusForbidden {
+		t.Errorf("passwords without an admin token set: got %d, want 403", w.Code)
+	}
+	AppConfig.AdminToken = "admin"
+	if w := export("&passwords=true", "guess"); w.Code != http.StatusUnauthorized {
+		t.Errorf("passwords with a wrong token: got %d, want 401", w.Code)
+	}
+	if w := export("&passwords=true", "admin"); !strings.Contains(w.Body.String(), `"password":"$2`) {
+		t.Errorf("passwords with the token: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,336 @@
+package userio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+)
+
+// Formats users are imported and exported in
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+)
+
+// ContentTypes of the formats
+var ContentTypes = map[string]string{
+	CSV:    "text/csv; charset=utf-8",
+	NDJSON: "application/x-ndjson",
+}
+
+// FormatOf picks the format of a content type, empty when it is none of
+// them
+func FormatOf(contentType string) string {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	switch mediaType {
+	case "text/csv":
+		return CSV
+	case "application/x-ndjson", "application/json":
+		return NDJSON
+	}
+	return ""
+}
+
+// maxLine is the longest ndjson line read
+const maxLine = 1 << 20
+
+// columns of a csv file, in the order they are exported
+var columns = []string{"id", "username", "email", "password", "created_at", "updated_at", "deleted_at"}
+
+// required columns of an imported csv file
+var required = []string{"username", "email"}
+
+// record is a user as it is written to a file, the password is the bcrypt
+// hash when the export includes it. deleted_at is always written, a null
+// restores a user on import while a missing one keeps them as they are.
+type record struct {
+	ID        uint       `json:"id,omitempty"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Password  string     `json:"password,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func newRecord(u models.User) record {
+	r := record{ID: u.ID, Username: u.Username, Email: u.Email, Password: u.Password, DeletedAt: u.DeletedAt}
+	if !u.CreatedAt.IsZero() {
+		r.CreatedAt = &u.CreatedAt
+	}
+	if !u.UpdatedAt.IsZero() {
+		r.UpdatedAt = &u.UpdatedAt
+	}
+	return r
+}
+
+// user validates the record and hashes a plaintext password, the id is
+// dropped since every database numbers its own users
+func (r record) user() (models.User, error) {
+	u := models.User{Username: strings.TrimSpace(r.Username), Email: strings.TrimSpace(r.Email), DeletedAt: r.DeletedAt}
+	if u.Username == "" {
+		return u, errors.New("username is required")
+	}
+	if !strings.Contains(u.Email, "@") {
+		return u, fmt.Errorf("%q is not an email address", u.Email)
+	}
+	if r.CreatedAt != nil {
+		u.CreatedAt = *r.CreatedAt
+	}
+	if r.UpdatedAt != nil {
+		u.UpdatedAt = *r.UpdatedAt
+	}
+	u.Password = r.Password
+	if u.Password != "" && !models.IsHashed(u.Password) {
+		hash, err := models.HashPassword(u.Password)
+		if err != nil {
+			return u, err
+		}
+		u.Password = hash
+	}
+	return u, nil
+}
+
+// Writer writes users one at a time
+type Writer interface {
+	Write(models.User) error
+	// Flush writes out what is buffered
+	Flush() error
+}
+
+// NewWriter writes users to w in the format
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case CSV:
+		cw := csv.NewWriter(w)
+		return &csvWriter{w: cw}, nil
+	case NDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s or %s", format, CSV, NDJSON)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (c *csvWriter) Write(u models.User) error {
+	if !c.header {
+		if err := c.w.Write(columns); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	r := newRecord(u)
+	return c.w.Write([]string{
+		strconv.FormatUint(uint64(r.ID), 10),
+		r.Username,
+		r.Email,
+		r.Password,
+		formatTime(r.CreatedAt),
+		formatTime(r.UpdatedAt),
+		formatTime(r.DeletedAt),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	if !c.header {
+		// an empty export still says what its columns are
+		if err := c.w.Write(columns); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(u models.User) error {
+	return n.enc.Encode(newRecord(u))
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return n.w.Flush()
+}
+
+// Row is one user read from a file, Err says why the row cannot be
+// imported. Line is the line of an ndjson file, or the record of a csv file
+// counting the header, where a record with quoted fields spanning lines is
+// one.
+type Row struct {
+	Line int
+	User models.User
+	Err  error
+	// HasDeletedAt is whether the row says when the user was deleted, a
+	// file without deleted_at leaves the users it updates as they are
+	HasDeletedAt bool
+}
+
+// Reader reads users one row at a time
+type Reader interface {
+	// Read returns the next row, or io.EOF after the last one. An error
+	// returned rather than set on the row means the rest of the file
+	// cannot be read.
+	Read() (Row, error)
+}
+
+// NewReader reads users from r in the format
+func NewReader(r io.Reader, format string) (Reader, error) {
+	switch format {
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		return &csvReader{r: cr}, nil
+	case NDJSON:
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), maxLine)
+		return &ndjsonReader{s: s}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s or %s", format, CSV, NDJSON)
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	header map[string]int
+	// line of the last record read, counting a record whose quoted fields
+	// span lines as one
+	line int
+}
+
+// readHeader maps the column names of the first line to their index
+func (c *csvReader) readHeader() error {
+	names, err := c.r.Read()
+	c.line++
+	if err == io.EOF {
+		return errors.New("the file is empty")
+	}
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, name := range columns {
+		known[name] = true
+	}
+	c.header = map[string]int{}
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !known[name] {
+			return fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(columns, ", "))
+		}
+		c.header[name] = i
+	}
+	for _, name := range required {
+		if _, ok := c.header[name]; !ok {
+			return fmt.Errorf("the %s column is required", name)
+		}
+	}
+	return nil
+}
+
+func (c *csvReader) Read() (Row, error) {
+	if c.header == nil {
+		if err := c.readHeader(); err != nil {
+			return Row{}, fmt.Errorf("csv header: %s", err)
+		}
+	}
+	fields, err := c.r.Read()
+	if err == io.EOF {
+		return Row{}, err
+	}
+	c.line++
+	if err != nil {
+		if perr, ok := err.(*csv.ParseError); ok {
+			return Row{Line: c.line, Err: perr.Err}, nil
+		}
+		return Row{}, err
+	}
+	row := Row{Line: c.line}
+	_, row.HasDeletedAt = c.header["deleted_at"]
+	if len(fields) != len(c.header) {
+		row.Err = fmt.Errorf("has %d fields, the header has %d", len(fields), len(c.header))
+		return row, nil
+	}
+	r := record{}
+	for name, i := range c.header {
+		value := fields[i]
+		switch name {
+		case "username":
+			r.Username = value
+		case "email":
+			r.Email = value
+		case "password":
+			r.Password = value
+		case "created_at", "updated_at", "deleted_at":
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				row.Err = fmt.Errorf("%s %q is not a RFC 3339 time", name, value)
+				return row, nil
+			}
+			switch name {
+			case "created_at":
+				r.CreatedAt = &t
+			case "updated_at":
+				r.UpdatedAt = &t
+			default:
+				r.DeletedAt = &t
+			}
+		}
+	}
+	row.User, row.Err = r.user()
+	return row, nil
+}
+
+type ndjsonReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (n *ndjsonReader) Read() (Row, error) {
+	for n.s.Scan() {
+		n.line++
+		text := strings.TrimSpace(n.s.Text())
+		if text == "" {
+			continue
+		}
+		row := Row{Line: n.line}
+		r := record{}
+		if err := json.Unmarshal([]byte(text), &r); err != nil {
+			row.Err = fmt.Errorf("invalid json: %s", err)
+			return row, nil
+		}
+		fields := map[string]json.RawMessage{}
+		json.Unmarshal([]byte(text), &fields)
+		_, row.HasDeletedAt = fields["deleted_at"]
+		row.User, row.Err = r.user()
+		return row, nil
+	}
+	if err := n.s.Err(); err != nil {
+		return Row{Line: n.line + 1}, err
+	}
+	return Row{}, io.EOF
+}
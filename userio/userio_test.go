@@ -0,0 +1,197 @@
+package userio
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	models.PasswordCost = bcrypt.MinCost
+}
+
+func readAll(t *testing.T, r Reader) []Row {
+	var rows []Row
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	if got := FormatOf("text/csv; charset=utf-8"); got != CSV {
+		t.Errorf("csv: got %q", got)
+	}
+	if got := FormatOf(" application/json ; charset=utf8"); got != NDJSON {
+		t.Errorf("json: got %q", got)
+	}
+	if got := FormatOf("application/x-ndjson"); got != NDJSON {
+		t.Errorf("ndjson: got %q", got)
+	}
+	if got := FormatOf("text/plain"); got != "" {
+		t.Errorf("plain text: got %q", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	hash, err := models.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2015, 3, 1, 12, 0, 0, 500, time.UTC)
+	deleted := created.Add(time.Hour)
+	users := []models.User{
+		{Username: "ann", Email: "ann@example.com", Password: hash},
+		{Username: "bob, \"jr\"", Email: "bob@example.com", Password: hash, DeletedAt: &deleted},
+	}
+	users[0].ID, users[0].CreatedAt, users[0].UpdatedAt = 7, created, created
+
+	for _, format := range []string{CSV, NDJSON} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			if err := w.Write(user); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := readAll(t, r)
+		if len(rows) != len(users) {
+			t.Fatalf("%s: read %d rows, want %d", format, len(rows), len(users))
+		}
+		for i, row := range rows {
+			want := users[i]
+			if row.Err != nil {
+				t.Errorf("%s row %d: %s", format, i, row.Err)
+				continue
+			}
+			got := row.User
+			if got.ID != 0 {
+				t.Errorf("%s row %d: the id %d was kept", format, i, got.ID)
+			}
+			if got.Username != want.Username || got.Email != want.Email || got.Password != want.Password {
+				t.Errorf("%s row %d: got %+v, want %+v", format, i, got, want)
+			}
+			if !got.CreatedAt.Equal(want.CreatedAt) || (got.DeletedAt == nil) != (want.DeletedAt == nil) ||
+				(got.DeletedAt != nil && !got.DeletedAt.Equal(*want.DeletedAt)) {
+				t.Errorf("%s row %d: times %s %v, want %s %v", format, i, got.CreatedAt, got.DeletedAt, want.CreatedAt, want.DeletedAt)
+			}
+		}
+	}
+}
+
+func TestEmptyCSVExportHasHeader(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, CSV)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != strings.Join(columns, ",")+"\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	doc := "Email,username,password\n" +
+		"ann@example.com,ann,plain\n" +
+		"no-at,bob,\n" +
+		"carl@example.com\n" +
+		"\"dan@example.com\",\"dan\nthe man\",\n" +
+		"eve@example.com,eve,\n" +
+		"fay@example.com,\"fa\"y,\n"
+	r, _ := NewReader(strings.NewReader(doc), CSV)
+	rows := readAll(t, r)
+	if len(rows) != 6 {
+		t.Fatalf("read %d rows, want 6", len(rows))
+	}
+	if rows[0].Err != nil || !models.IsHashed(rows[0].User.Password) || !rows[0].User.CheckPassword("plain") {
+		t.Errorf("a plaintext password is hashed: got %+v, %v", rows[0].User, rows[0].Err)
+	}
+	if rows[1].Err == nil || rows[2].Err == nil {
+		t.Errorf("bad rows read without an error: %v, %v", rows[1].Err, rows[2].Err)
+	}
+	// the record spanning two lines counts once, bad quotes included
+	for i, line := range []int{2, 3, 4, 5, 6, 7} {
+		if rows[i].Line != line {
+			t.Errorf("row %d: line %d, want %d", i, rows[i].Line, line)
+		}
+	}
+	if rows[4].Err != nil || rows[4].User.Password != "" {
+		t.Errorf("a row without a password: got %+v, %v", rows[4].User, rows[4].Err)
+	}
+	if rows[5].Err == nil {
+		t.Error("a bare quote read without an error")
+	}
+	if rows[0].HasDeletedAt {
+		t.Error("a file without deleted_at says when users were deleted")
+	}
+
+	r, _ = NewReader(strings.NewReader("email,username,deleted_at\nann@example.com,ann,\n"), CSV)
+	if rows := readAll(t, r); !rows[0].HasDeletedAt || rows[0].User.DeletedAt != nil {
+		t.Errorf("an empty deleted_at: got %+v", rows[0])
+	}
+}
+
+func TestReadCSVHeader(t *testing.T) {
+	for _, doc := range []string{"", "username,email,nickname\n", "username,password\n"} {
+		r, _ := NewReader(strings.NewReader(doc), CSV)
+		if _, err := r.Read(); err == nil || err == io.EOF {
+			t.Errorf("%q: expected a header error, got %v", doc, err)
+		}
+	}
+}
+
+func TestReadNDJSON(t *testing.T) {
+	doc := `{"username":"ann","email":"ann@example.com"}
+
+{"username":"bob"
+{"username":"","email":"carl@example.com"}
+{"username":"dan","email":"dan@example.com","deleted_at":null}
+`
+	r, _ := NewReader(strings.NewReader(doc), NDJSON)
+	rows := readAll(t, r)
+	if len(rows) != 4 {
+		t.Fatalf("read %d rows, want 4", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Line != 1 || rows[0].HasDeletedAt {
+		t.Errorf("row 0: %+v", rows[0])
+	}
+	if rows[1].Err == nil || rows[1].Line != 3 {
+		t.Errorf("invalid json: %+v", rows[1])
+	}
+	if rows[2].Err == nil || rows[2].Line != 4 {
+		t.Errorf("no username: %+v", rows[2])
+	}
+	if rows[3].Err != nil || !rows[3].HasDeletedAt {
+		t.Errorf("a null deleted_at: %+v", rows[3])
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("NewWriter: expected an error")
+	}
+	if _, err := NewReader(strings.NewReader(""), "xml"); err == nil {
+		t.Error("NewReader: expected an error")
+	}
+}
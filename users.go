@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/cp16net/hod-test-app/mysql/models"
+	"github.com/cp16net/hod-test-app/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// userTable is the listing of one sql backend on the sql page
+type userTable struct {
+	Backend string
+	Page    models.UserPage
+	Error   error
+}
+
+// listQuery turns list options back into the query string listOptions reads
+func listQuery(o models.ListOptions) url.Values {
+	q := url.Values{}
+	q.Set("page", strconv.Itoa(o.Page))
+	q.Set("per_page", strconv.Itoa(o.PerPage))
+	q.Set("sort", o.Sort)
+	if o.Desc {
+		q.Set("order", "desc")
+	}
+	switch {
+	case o.Deleted:
+		q.Set("deleted", "true")
+	case o.IncludeDeleted:
+		q.Set("deleted", "all")
+	}
+	for name, v := range map[string]string{
+		"username":       o.Username,
+		"email":          o.Email,
+		"created_after":  models.FormatTimeFilter(o.CreatedAfter),
+		"created_before": models.FormatTimeFilter(o.CreatedBefore),
+	} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	return q
+}
+
+// sortURL links to the first page sorted by column, flipping the order
+// when the listing is already sorted by it
+func sortURL(o models.ListOptions, column string) string {
+	o.Desc = o.Sort == column && !o.Desc
+	o.Sort, o.Page = column, 1
+	return "/sql?" + listQuery(o).Encode()
+}
+
+// pageURL links to the page delta pages away from the current one
+func pageURL(o models.ListOptions, delta int) string {
+	o.Page += delta
+	return "/sql?" + listQuery(o).Encode()
+}
+
+// UserData for the user detail page
+type UserData struct {
+	Backend string
+	User    models.User
+	Error   string
+}
+
+// Deleted reports whether the user is soft deleted
+func (d UserData) Deleted() bool {
+	return d.User.DeletedAt != nil
+}
+
+// userPageRequest resolves the backend and id of a user page
+func userPageRequest(w http.ResponseWriter, ps httprouter.Params) (store.UserStore, uint, bool) {
+	backend, ok := sqlBackends[ps.ByName("backend")]
+	if !ok {
+		http.NotFound(w, nil)
+		return backend, 0, false
+	}
+	id, err := userID(ps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return backend, 0, false
+	}
+	return backend, id, true
+}
+
+// renderUser shows the user page, or why the user could not be loaded
+func renderUser(w http.ResponseWriter, ps httprouter.Params, backend store.UserStore, id uint, status int, message string) {
+	user, err := backend.User(id)
+	if err == models.ErrUserNotFound {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		renderUnavailable(w, ps.ByName("backend"), err)
+		return
+	}
+	w.WriteHeader(status)
+	renderTemplate(w, "templates/user.html", UserData{Backend: ps.ByName("backend"), User: user, Error: message})
+}
+
+func userHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userPageRequest(w, ps)
+	if !ok {
+		return
+	}
+	renderUser(w, ps, backend, id, http.StatusOK, "")
+}
+
+// userUpdateHandler saves the edit form, an empty password is left as is
+func userUpdateHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	backend, id, ok := userPageRequest(w, ps)
+	if !ok {
+		return
+	}
+	username, email := r.PostFormValue("username"), r.PostFormValue("email")
+	update := models.UserUpdate{Username: &username, Email: &email}
+	if password := r.PostFormValue("password"); password != "" {
+		update.Password = &password
+	}
+	if err := update.Validate(); err != nil {
+		renderUser(w, ps, backend, id, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := backend.UpdateUser(id, update); err != nil {
+		renderUser(w, ps, backend, id, http.StatusBadRequest, err.Error())
+		return
+	}
+	http.Redirect(w, r, userURL(ps), http.StatusFound)
+}
+
+// userActionHandler runs a delete, restore or purge on the user and goes
+// to next, an empty next goes back to the user page
+func userActionHandler(action func(store.UserStore) func(uint) error, next string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		backend, id, ok := userPageRequest(w, ps)
+		if !ok {
+			return
+		}
+		if err := action(backend)(id); err != nil {
+			renderUser(w, ps, backend, id, http.StatusBadRequest, err.Error())
+			return
+		}
+		to := next
+		if to == "" {
+			to = userURL(ps)
+		}
+		http.Redirect(w, r, to, http.StatusFound)
+	}
+}
+
+var (
+	userDeleteHandler  = userActionHandler(func(b store.UserStore) func(uint) error { return b.DeleteUser }, "")
+	userRestoreHandler = userActionHandler(func(b store.UserStore) func(uint) error { return b.RestoreUser }, "")
+	userPurgeHandler   = userActionHandler(func(b store.UserStore) func(uint) error { return b.PurgeUser }, "/sql")
+)
+
+func userURL(ps httprouter.Params) string {
+	return fmt.Sprintf("/users/%s/%s", ps.ByName("backend"), ps.ByName("id"))
+}